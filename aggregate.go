@@ -0,0 +1,219 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// AggregateConfig is configuration of time-bucketed aggregate statistics
+type AggregateConfig struct {
+	// Intervals are lengths of aggregation buckets e.g. 5m, 1h or 24h; defaults to 5m, 1h and 24h.
+	// Every interval must divide a day; buckets start at midnight in configured time zone.
+	Intervals []string `json:"intervals"`
+	// durations are parsed intervals
+	durations []time.Duration
+}
+
+// Validate checks aggregate configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *AggregateConfig) Validate() error {
+	if c.Intervals == nil {
+		c.Intervals = []string{"5m", "1h", "24h"}
+	}
+
+	c.durations = make([]time.Duration, len(c.Intervals))
+	for i, interval := range c.Intervals {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return fmt.Errorf("Invalid aggregation interval %q: %v", interval, err)
+		}
+		if d < time.Minute || (24*time.Hour)%d != 0 {
+			return fmt.Errorf("Invalid aggregation interval %q: must be at least 1m and divide a day", interval)
+		}
+		c.durations[i] = d
+	}
+
+	return nil
+}
+
+// Aggregate are parking lot statistics of a time bucket
+type Aggregate struct {
+	// Camera is name of the camera monitoring the parking lot
+	Camera string `json:"camera"`
+	// Interval is bucket length e.g. 1h
+	Interval string `json:"interval"`
+	// Start is start of the bucket
+	Start time.Time `json:"start"`
+	// End is end of the bucket
+	End time.Time `json:"end"`
+	// In is number of cars which entered the parking lot during the bucket
+	In int `json:"in"`
+	// Out is number of cars which left the parking lot during the bucket
+	Out int `json:"out"`
+	// Peak is peak occupancy during the bucket
+	Peak int `json:"peak"`
+	// Mean is time-weighted mean occupancy during the bucket
+	Mean float64 `json:"mean"`
+	// Occupancy is occupancy at the end of the bucket
+	Occupancy int `json:"occupancy"`
+}
+
+// bucket accumulates statistics of a time bucket
+type bucket struct {
+	// interval is bucket length as configured
+	interval string
+	// start is start of the bucket
+	start time.Time
+	// end is end of the bucket
+	end time.Time
+	// in is number of cars in
+	in int
+	// out is number of cars out
+	out int
+	// peak is peak occupancy
+	peak int
+	// area is occupancy integrated over observed time in car-seconds
+	area float64
+	// observed is time the occupancy has been observed for
+	observed time.Duration
+	// last is time of the last observation
+	last time.Time
+	// occupancy is the last observed occupancy
+	occupancy int
+}
+
+// advance integrates occupancy observed since the last observation until time t
+func (b *bucket) advance(t time.Time) {
+	if d := t.Sub(b.last); d > 0 {
+		b.area += float64(b.occupancy) * d.Seconds()
+		b.observed += d
+		b.last = t
+	}
+}
+
+// Aggregator computes time-bucketed aggregate statistics from every counter change.
+// It is not safe for concurrent use.
+type Aggregator struct {
+	// camera is camera name
+	camera string
+	// config is aggregate configuration
+	config *AggregateConfig
+	// loc is time zone buckets are aligned to
+	loc *time.Location
+	// buckets are the current buckets of all intervals
+	buckets []*bucket
+}
+
+// NewAggregator creates new aggregator of camera statistics configured in ac and returns it.
+// Buckets are aligned to midnight in time zone loc.
+func NewAggregator(camera string, ac *AggregateConfig, loc *time.Location) *Aggregator {
+	return &Aggregator{
+		camera:  camera,
+		config:  ac,
+		loc:     loc,
+		buckets: make([]*bucket, len(ac.durations)),
+	}
+}
+
+// Observe records occupancy and crossings observed at time t.
+// It returns aggregates of buckets which ended before t.
+func (a *Aggregator) Observe(t time.Time, occupancy int, crossings []*Crossing) []*Aggregate {
+	var aggregates []*Aggregate
+
+	for i, d := range a.config.durations {
+		b := a.buckets[i]
+		if b == nil {
+			start, end := bucketBounds(t, d, a.loc)
+			b = &bucket{interval: a.config.Intervals[i], start: start, end: end, last: t, occupancy: occupancy, peak: occupancy}
+			a.buckets[i] = b
+		}
+
+		// close buckets which ended since the last observation
+		for !t.Before(b.end) {
+			b.advance(b.end)
+			aggregates = append(aggregates, b.aggregate(a.camera))
+			start, end := bucketBounds(b.end, d, a.loc)
+			b = &bucket{interval: b.interval, start: start, end: end, last: start, occupancy: b.occupancy, peak: b.occupancy}
+			a.buckets[i] = b
+		}
+
+		b.advance(t)
+		for _, c := range crossings {
+			switch c.LotDirection() {
+			case DirIn:
+				b.in += c.Cars()
+			case DirOut:
+				b.out += c.Cars()
+			}
+		}
+		b.occupancy = occupancy
+		if occupancy > b.peak {
+			b.peak = occupancy
+		}
+	}
+
+	return aggregates
+}
+
+// aggregate returns statistics of the bucket of camera
+func (b *bucket) aggregate(camera string) *Aggregate {
+	mean := float64(b.occupancy)
+	if b.observed > 0 {
+		mean = b.area / b.observed.Seconds()
+	}
+
+	return &Aggregate{
+		Camera:    camera,
+		Interval:  b.interval,
+		Start:     b.start,
+		End:       b.end,
+		In:        b.in,
+		Out:       b.out,
+		Peak:      b.peak,
+		Mean:      mean,
+		Occupancy: b.occupancy,
+	}
+}
+
+// bucketBounds returns start and end of the bucket of length d which contains time t.
+// Buckets are aligned to midnight in time zone loc and never span midnight.
+// Daily buckets span the calendar day, which is 23 or 25 hours long when clocks change.
+func bucketBounds(t time.Time, d time.Duration, loc *time.Location) (time.Time, time.Time) {
+	t = t.In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	next := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+	if d == 24*time.Hour {
+		return midnight, next
+	}
+
+	start := midnight.Add(t.Sub(midnight) / d * d)
+	end := start.Add(d)
+	if end.After(next) {
+		end = next
+	}
+
+	return start, end
+}
@@ -0,0 +1,198 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	// embed time zone database so that the tests don't depend on the system one
+	_ "time/tzdata"
+)
+
+func TestAggregateConfigValidate(t *testing.T) {
+	tests := []struct {
+		intervals []string
+		fail      bool
+	}{
+		{nil, false},
+		{[]string{"15m", "1h", "24h"}, false},
+		{[]string{"1m"}, false},
+		{[]string{"30s"}, true},
+		{[]string{"7m"}, true},
+		{[]string{"48h"}, true},
+		{[]string{"hourly"}, true},
+	}
+
+	for _, tt := range tests {
+		c := &AggregateConfig{Intervals: tt.intervals}
+		if err := c.Validate(); (err != nil) != tt.fail {
+			t.Errorf("Validate() of %v error = %v, want failure %v", tt.intervals, err, tt.fail)
+		}
+	}
+}
+
+func TestBucketBounds(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		t     string
+		d     time.Duration
+		loc   *time.Location
+		start string
+		end   string
+	}{
+		{"hour", "2026-01-02T10:20:00Z", time.Hour, time.UTC, "2026-01-02T10:00:00Z", "2026-01-02T11:00:00Z"},
+		{"bucket start", "2026-01-02T10:15:00Z", 15 * time.Minute, time.UTC, "2026-01-02T10:15:00Z",
+			"2026-01-02T10:30:00Z"},
+		{"day", "2026-01-02T23:59:59Z", 24 * time.Hour, time.UTC, "2026-01-02T00:00:00Z", "2026-01-03T00:00:00Z"},
+		{"half hour time zone", "2026-01-02T01:40:00Z", 15 * time.Minute, kolkata, "2026-01-02T07:00:00+05:30",
+			"2026-01-02T07:15:00+05:30"},
+		{"day in time zone", "2026-01-02T20:00:00Z", 24 * time.Hour, kolkata, "2026-01-03T00:00:00+05:30",
+			"2026-01-04T00:00:00+05:30"},
+		{"before spring forward", "2026-03-08T01:30:00-05:00", time.Hour, newYork, "2026-03-08T01:00:00-05:00",
+			"2026-03-08T03:00:00-04:00"},
+		{"after spring forward", "2026-03-08T03:30:00-04:00", time.Hour, newYork, "2026-03-08T03:00:00-04:00",
+			"2026-03-08T04:00:00-04:00"},
+		{"spring forward day", "2026-03-08T12:00:00-04:00", 24 * time.Hour, newYork, "2026-03-08T00:00:00-05:00",
+			"2026-03-09T00:00:00-04:00"},
+		{"first hour of fall back", "2026-11-01T01:30:00-04:00", time.Hour, newYork, "2026-11-01T01:00:00-04:00",
+			"2026-11-01T01:00:00-05:00"},
+		{"repeated hour of fall back", "2026-11-01T01:30:00-05:00", time.Hour, newYork, "2026-11-01T01:00:00-05:00",
+			"2026-11-01T02:00:00-05:00"},
+		{"fall back day", "2026-11-01T12:00:00-05:00", 24 * time.Hour, newYork, "2026-11-01T00:00:00-04:00",
+			"2026-11-02T00:00:00-05:00"},
+		{"last hour of fall back day", "2026-11-01T23:30:00-05:00", 24 * time.Hour, newYork,
+			"2026-11-01T00:00:00-04:00", "2026-11-02T00:00:00-05:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := bucketBounds(parseTime(t, tt.t), tt.d, tt.loc)
+			if want := parseTime(t, tt.start); !start.Equal(want) {
+				t.Errorf("start = %v, want %v", start, want)
+			}
+			if want := parseTime(t, tt.end); !end.Equal(want) {
+				t.Errorf("end = %v, want %v", end, want)
+			}
+		})
+	}
+}
+
+func TestAggregatorObserve(t *testing.T) {
+	config = NewConfig()
+
+	in := &Crossing{Direction: DirIn}
+	out := &Crossing{Direction: DirOut}
+	reverted := &Crossing{Direction: DirIn, Revert: true}
+	uncounted := &Crossing{Direction: DirIn, Gate: "ramp"}
+
+	type observation struct {
+		t         string
+		occupancy int
+		crossings []*Crossing
+	}
+	tests := []struct {
+		name         string
+		observations []observation
+		want         Aggregate
+	}{
+		{
+			name: "in and out",
+			observations: []observation{
+				{"2026-01-02T10:00:00Z", 0, nil},
+				{"2026-01-02T10:15:00Z", 1, []*Crossing{in}},
+				{"2026-01-02T10:45:00Z", 0, []*Crossing{out}},
+				{"2026-01-02T11:00:01Z", 0, nil},
+			},
+			want: Aggregate{In: 1, Out: 1, Peak: 1, Mean: 0.5, Occupancy: 0},
+		},
+		{
+			name: "reverted count",
+			observations: []observation{
+				{"2026-01-02T10:00:00Z", 2, nil},
+				{"2026-01-02T10:30:00Z", 3, []*Crossing{in, in}},
+				{"2026-01-02T10:30:00Z", 2, []*Crossing{reverted}},
+				{"2026-01-02T11:00:00Z", 2, nil},
+			},
+			want: Aggregate{In: 1, Out: 0, Peak: 3, Mean: 2, Occupancy: 2},
+		},
+		{
+			name: "gate crossing not counted in the lot",
+			observations: []observation{
+				{"2026-01-02T10:00:00Z", 4, []*Crossing{uncounted}},
+				{"2026-01-02T12:30:00Z", 4, nil},
+			},
+			want: Aggregate{In: 0, Out: 0, Peak: 4, Mean: 4, Occupancy: 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &AggregateConfig{Intervals: []string{"1h"}}
+			if err := ac.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			a := NewAggregator("test", ac, time.UTC)
+
+			var aggregates []*Aggregate
+			for _, o := range tt.observations {
+				aggregates = append(aggregates, a.Observe(parseTime(t, o.t), o.occupancy, o.crossings)...)
+			}
+			if len(aggregates) == 0 {
+				t.Fatal("no bucket ended")
+			}
+
+			got := aggregates[0]
+			if !got.Start.Equal(parseTime(t, "2026-01-02T10:00:00Z")) || !got.End.Equal(parseTime(t, "2026-01-02T11:00:00Z")) {
+				t.Errorf("bucket = %v - %v, want 10:00 - 11:00", got.Start, got.End)
+			}
+			if got.In != tt.want.In || got.Out != tt.want.Out || got.Peak != tt.want.Peak ||
+				got.Mean != tt.want.Mean || got.Occupancy != tt.want.Occupancy {
+				t.Errorf("aggregate = in %d out %d peak %d mean %f occupancy %d, want %+v", got.In, got.Out,
+					got.Peak, got.Mean, got.Occupancy, tt.want)
+			}
+		})
+	}
+}
+
+// parseTime parses RFC 3339 time s and fails test t if it is invalid
+func parseTime(t *testing.T, s string) time.Time {
+	t.Helper()
+
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ts
+}
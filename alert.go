@@ -0,0 +1,117 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"image"
+	"time"
+
+	"github.com/google/uuid"
+	"gocv.io/x/gocv"
+)
+
+const (
+	// GateBlockedAlert is raised when a car stands still in the gate for too long
+	GateBlockedAlert = "gate_blocked"
+	// NoParkingAlert is raised when a car stands still in a no parking zone for too long
+	NoParkingAlert = "no_parking"
+	// LongQueueAlert is raised when the queue at the entry barrier is too long for too long
+	LongQueueAlert = "long_queue"
+	// snapshotPadding is number of pixels car snapshots are padded with around the detected car
+	snapshotPadding = 20
+)
+
+// Alert is an operating alert raised and cleared by the counter
+type Alert struct {
+	// Time is time the alert was raised or cleared
+	Time time.Time `json:"time"`
+	// Camera is name of the camera which raised the alert
+	Camera string `json:"camera"`
+	// Type is alert type e.g. gate_blocked
+	Type string `json:"type"`
+	// Active is true when the alert is raised and false when it's cleared
+	Active bool `json:"active"`
+	// TrackID is ID of the tracked car which caused the alert; omitted if the alert is not caused by a single car
+	TrackID *uuid.UUID `json:"track_id,omitempty"`
+	// Point is the last known position of the car which caused the alert
+	Point *image.Point `json:"point,omitempty"`
+	// Since is time the alerting condition started
+	Since time.Time `json:"since"`
+	// Duration is number of seconds the alerting condition lasted
+	Duration float64 `json:"duration"`
+	// Zone is name of the zone the alert was raised in; omitted if the alert is not raised in a zone
+	Zone string `json:"zone,omitempty"`
+	// Length is queue length; omitted if the alert is not raised for a queue
+	Length int `json:"length,omitempty"`
+	// Snapshot is JPEG snapshot of the car which caused the alert encoded in base64; omitted if not taken
+	Snapshot []byte `json:"snapshot,omitempty"`
+	// rect is the last known bounding box of the car which caused the alert
+	rect image.Rectangle
+}
+
+// NewCarAlert creates new alert of type typ caused by car since time since and returns it.
+// The alert is raised if active is true and cleared otherwise.
+func NewCarAlert(typ string, active bool, car *Car, since, now time.Time) *Alert {
+	id := car.ID
+	p := car.Traject[len(car.Traject)-1]
+
+	return &Alert{
+		Time:     now,
+		Camera:   config.Camera,
+		Type:     typ,
+		Active:   active,
+		TrackID:  &id,
+		Point:    &p,
+		Since:    since,
+		Duration: now.Sub(since).Seconds(),
+		rect:     car.Rect,
+	}
+}
+
+// snapshot returns JPEG snapshot of the car in bounding box rect in img cropped with padding.
+// It returns nil if rect is empty or the snapshot can't be encoded.
+func snapshot(img *gocv.Mat, rect image.Rectangle) []byte {
+	if rect.Empty() {
+		return nil
+	}
+
+	rect = rect.Inset(-snapshotPadding).Intersect(image.Rect(0, 0, img.Cols(), img.Rows()))
+	if rect.Empty() {
+		return nil
+	}
+	crop := img.Region(rect)
+	defer crop.Close()
+
+	buf, err := gocv.IMEncode(gocv.JPEGFileExt, crop)
+	if err != nil {
+		return nil
+	}
+	defer buf.Close()
+
+	// copy the bytes as the buffer is released when closed
+	data := make([]byte, buf.Len())
+	copy(data, buf.GetBytes())
+
+	return data
+}
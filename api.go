@@ -0,0 +1,587 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// ResetCommand resets parking lot in and out counters
+	ResetCommand = "reset"
+	// OccupancyCommand adjusts parking lot occupancy
+	OccupancyCommand = "occupancy"
+	// cmdTimeout is max time to wait for a command to be applied
+	cmdTimeout = 5 * time.Second
+	// redacted replaces secrets in served configuration
+	redacted = "REDACTED"
+)
+
+// HTTPConfig is configuration of embedded HTTP server
+type HTTPConfig struct {
+	// Addr is address the HTTP server listens on e.g. :8080; the server is disabled if empty
+	Addr string `json:"addr"`
+	// Token is bearer token required by POST requests; POST requests are not authenticated if empty
+	Token string `json:"token"`
+}
+
+// Validate checks HTTP server configuration is valid and returns error if it is not
+func (c *HTTPConfig) Validate() error {
+	if c.Addr == "" {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return fmt.Errorf("Invalid HTTP server address %q: %v", c.Addr, err)
+	}
+
+	return nil
+}
+
+// Command is a command which changes parking lot counters
+type Command struct {
+	// Name is command name: reset or occupancy
+	Name string `json:"command"`
+	// Occupancy is the new occupancy; if set with reset command, it replaces the current occupancy
+	Occupancy *int `json:"occupancy,omitempty"`
+	// Delta is number of cars added to the current occupancy
+	Delta *int `json:"delta,omitempty"`
+	// Reason is optional reason of the correction recorded in the audit trail
+	Reason string `json:"reason,omitempty"`
+	// Source is what issued the command e.g. api or schedule
+	Source string `json:"-"`
+	// done receives the result of the command
+	done chan error
+}
+
+// Validate checks the command is valid and returns error if it is not
+func (c *Command) Validate() error {
+	if c.Occupancy != nil && *c.Occupancy < 0 {
+		return fmt.Errorf("Invalid occupancy: %d", *c.Occupancy)
+	}
+
+	switch c.Name {
+	case ResetCommand:
+		if c.Delta != nil {
+			return fmt.Errorf("Command %s does not accept delta", c.Name)
+		}
+	case OccupancyCommand:
+		if (c.Occupancy == nil) == (c.Delta == nil) {
+			return fmt.Errorf("Command %s requires either occupancy or delta", c.Name)
+		}
+	default:
+		return fmt.Errorf("Unknown command: %q", c.Name)
+	}
+
+	return nil
+}
+
+// Apply applies the command to parking lot p
+// It returns error if the command would make the occupancy negative.
+func (c *Command) Apply(p *ParkingLot) error {
+	switch c.Name {
+	case ResetCommand:
+		p.Reset()
+		if c.Occupancy != nil {
+			p.SetOccupancy(*c.Occupancy)
+		}
+	case OccupancyCommand:
+		if c.Occupancy != nil {
+			p.SetOccupancy(*c.Occupancy)
+			return nil
+		}
+		if p.Occupancy()+*c.Delta < 0 {
+			return fmt.Errorf("Occupancy can't be negative: %d", p.Occupancy()+*c.Delta)
+		}
+		p.SetOccupancy(p.Occupancy() + *c.Delta)
+	}
+
+	return nil
+}
+
+// Totals are parking lot counters
+type Totals struct {
+	// Time is time the counters were updated
+	Time time.Time `json:"time"`
+	// In is number of cars which entered the parking lot since the last reset
+	In int `json:"in"`
+	// Out is number of cars which left the parking lot since the last reset
+	Out int `json:"out"`
+	// Occupancy is number of cars parked in the parking lot
+	Occupancy int `json:"occupancy"`
+	// Capacity is number of parking spaces; omitted if not configured
+	Capacity int `json:"capacity,omitempty"`
+	// State is occupancy state; omitted if capacity is not configured
+	State OccupancyState `json:"state,omitempty"`
+	// Baseline is number of cars parked in the parking lot at the last reset
+	Baseline int `json:"baseline"`
+	// ResetAt is time of the last reset
+	ResetAt time.Time `json:"reset_at"`
+	// Gates are counters of counting gates keyed by gate name; omitted if no gates are configured
+	Gates map[string]GateTotals `json:"gates,omitempty"`
+}
+
+// Track is a tracked car
+type Track struct {
+	// ID is track ID
+	ID uuid.UUID `json:"id"`
+	// Point is the last known car position
+	Point image.Point `json:"point"`
+	// Direction is car direction
+	Direction string `json:"direction"`
+	// Traject is car trajectory
+	Traject []image.Point `json:"trajectory"`
+	// Times are times of the trajectory points
+	Times []time.Time `json:"times,omitempty"`
+	// Speed is estimated car speed in km/h; omitted if not estimated
+	Speed float64 `json:"speed,omitempty"`
+	// Counted is true if the car has been counted
+	Counted bool `json:"counted"`
+	// Plausible is true if the car track is plausible to be counted
+	Plausible bool `json:"plausible"`
+	// Gone is true if the car is no longer detected
+	Gone bool `json:"gone"`
+	// Missed is number of frames the car has not been detected in
+	Missed int `json:"missed_frames"`
+}
+
+// CameraStatus is status of camera video processing
+type CameraStatus struct {
+	// Name is camera name
+	Name string `json:"name"`
+	// Source is video source
+	Source string `json:"source"`
+	// Started is time the processing started
+	Started time.Time `json:"started"`
+	// LastFrame is time the last frame was processed
+	LastFrame time.Time `json:"last_frame"`
+	// Frames is number of processed frames
+	Frames int64 `json:"frames"`
+	// Dropped is number of frames read from the video source which were not processed
+	Dropped int64 `json:"dropped"`
+	// FPS is number of frames processed per second
+	FPS float64 `json:"fps"`
+	// Inference is inference time of the last frame in milliseconds
+	Inference float64 `json:"inference_ms"`
+	// Tracks is number of tracked cars
+	Tracks int `json:"tracks"`
+}
+
+// State is the latest counter state shared by frameRunner with the API
+type State struct {
+	// mu protects the state
+	mu sync.RWMutex
+	// totals are parking lot counters
+	totals Totals
+	// tracks are tracked cars
+	tracks []*Track
+	// camera is camera status
+	camera CameraStatus
+	// spaces is map of parking spaces
+	spaces *SpaceMap
+}
+
+// NewState creates new state of camera with name reading video from source and returns it
+func NewState(name, source string) *State {
+	return &State{
+		tracks: []*Track{},
+		camera: CameraStatus{
+			Name:    name,
+			Source:  source,
+			Started: time.Now(),
+		},
+	}
+}
+
+// Update updates the state with parking lot p counters, tracked centroids and cars and inference performance perf.
+// It is called every time a frame has been processed.
+func (s *State) Update(p *ParkingLot, centroids CentroidMap, cars CarMap, perf *Perf) {
+	tracks := make([]*Track, 0, len(cars))
+	for id, car := range cars {
+		// trajectory points are only ever appended, never modified, so the points tracked so far are shared
+		// with the car instead of being copied every frame; they are only read when the tracks are requested
+		n := len(car.Traject)
+		t := &Track{
+			ID:        id,
+			Direction: car.Dir.String(),
+			Traject:   car.Traject[:n:n],
+			Times:     car.Times[:n:n],
+			Speed:     car.Speed,
+			Counted:   car.counted,
+			Plausible: car.plausible,
+			Gone:      car.gone,
+		}
+		if n > 0 {
+			t.Point = car.Traject[len(car.Traject)-1]
+		}
+		if c, ok := centroids[id]; ok {
+			t.Point = c.Point
+			t.Missed = c.goneCount
+		}
+		tracks = append(tracks, t)
+	}
+	for id, c := range centroids {
+		if _, ok := cars[id]; !ok {
+			tracks = append(tracks, &Track{ID: id, Point: c.Point, Direction: STILL.String(), Missed: c.goneCount})
+		}
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].ID.String() < tracks[j].ID.String()
+	})
+
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.totals = newTotals(p)
+	s.tracks = tracks
+	if !s.camera.LastFrame.IsZero() {
+		if dt := now.Sub(s.camera.LastFrame).Seconds(); dt > 0 {
+			// exponentially weighted moving average smooths out frame time jitter
+			if s.camera.FPS == 0 {
+				s.camera.FPS = 1 / dt
+			} else {
+				s.camera.FPS = 0.9*s.camera.FPS + 0.1/dt
+			}
+		}
+	}
+	s.camera.LastFrame = now
+	s.camera.Frames++
+	s.camera.Tracks = len(tracks)
+	if perf != nil {
+		s.camera.Inference = perf.Net
+	}
+}
+
+// DropFrame counts a frame which was read from the video source but not processed
+func (s *State) DropFrame() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.camera.Dropped++
+}
+
+// UpdateTotals updates the state with parking lot p counters
+func (s *State) UpdateTotals(p *ParkingLot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.totals = newTotals(p)
+}
+
+// Totals returns parking lot counters
+func (s *State) Totals() Totals {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.totals
+}
+
+// Tracks returns tracked cars
+func (s *State) Tracks() []*Track {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tracks
+}
+
+// UpdateSpaces updates the state with map of parking spaces m
+func (s *State) UpdateSpaces(m *SpaceMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.spaces = m
+}
+
+// Spaces returns map of parking spaces
+func (s *State) Spaces() *SpaceMap {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.spaces
+}
+
+// Camera returns camera status
+func (s *State) Camera() CameraStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.camera
+}
+
+// newTotals returns counters of parking lot p
+func newTotals(p *ParkingLot) Totals {
+	t := Totals{
+		Time:      time.Now(),
+		In:        p.TotalIn,
+		Out:       p.TotalOut,
+		Occupancy: p.Occupancy(),
+		Capacity:  config.Occupancy.Capacity,
+		State:     p.State,
+		Baseline:  p.Baseline,
+		ResetAt:   p.ResetAt,
+	}
+
+	if len(p.Gates) > 0 {
+		t.Gates = make(map[string]GateTotals, len(p.Gates))
+		for name, g := range p.Gates {
+			t.Gates[name] = *g
+		}
+	}
+
+	return t
+}
+
+// API is embedded REST API which serves the counter state and accepts commands
+type API struct {
+	// config is program configuration
+	config *Config
+	// state is the counter state
+	state *State
+	// ctrl is used to send commands to frameRunner
+	ctrl chan<- *Command
+	// pub is publisher whose sinks status is reported; nil if publishing is disabled
+	pub *FanOut
+	// mux routes API requests
+	mux *http.ServeMux
+}
+
+// NewAPI creates new API serving state and sending commands to ctrl and returns it.
+// If pub is not nil, status of its sinks is reported along with camera status.
+func NewAPI(cfg *Config, state *State, ctrl chan<- *Command, pub *FanOut) *API {
+	a := &API{
+		config: cfg,
+		state:  state,
+		ctrl:   ctrl,
+		pub:    pub,
+		mux:    http.NewServeMux(),
+	}
+
+	a.mux.HandleFunc("/api/totals", a.get(a.totals))
+	a.mux.HandleFunc("/api/occupancy", a.occupancy)
+	a.mux.HandleFunc("/api/tracks", a.get(a.tracks))
+	a.mux.HandleFunc("/api/spaces", a.get(a.spaces))
+	a.mux.HandleFunc("/api/status", a.get(a.status))
+	a.mux.HandleFunc("/api/config", a.get(a.configuration))
+	a.mux.HandleFunc("/api/reset", a.post(ResetCommand))
+
+	return a
+}
+
+// Handle registers handler h for requests to pattern
+func (a *API) Handle(pattern string, h http.Handler) {
+	a.mux.Handle(pattern, h)
+}
+
+// ServeHTTP implements http.Handler interface for API
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// get returns handler which responds to GET requests with JSON encoded value returned by f
+func (a *API) get(f func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+			return
+		}
+		writeJSON(w, http.StatusOK, f())
+	}
+}
+
+// post returns handler which applies command with name to parking lot counters
+// and responds with the updated counters.
+func (a *API) post(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+			return
+		}
+
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("Invalid or missing token"))
+			return
+		}
+
+		cmd := &Command{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(cmd); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid request body: %v", err))
+				return
+			}
+		}
+		cmd.Name = name
+		cmd.Source = "api"
+
+		if err := cmd.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := a.apply(r, cmd); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, a.totals())
+	}
+}
+
+// apply sends command cmd to frameRunner and waits for it to be applied
+// It returns error if the command fails or is not applied in time.
+func (a *API) apply(r *http.Request, cmd *Command) error {
+	cmd.done = make(chan error, 1)
+
+	timer := time.NewTimer(cmdTimeout)
+	defer timer.Stop()
+
+	select {
+	case a.ctrl <- cmd:
+	case <-timer.C:
+		return fmt.Errorf("Timed out sending %s command", cmd.Name)
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+
+	select {
+	case err := <-cmd.done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("Timed out applying %s command", cmd.Name)
+	}
+}
+
+// authorized returns true if request r carries the configured bearer token or if no token is configured
+func (a *API) authorized(r *http.Request) bool {
+	if a.config.HTTP.Token == "" {
+		return true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.config.HTTP.Token)) == 1
+}
+
+// occupancy serves parking lot occupancy on GET and adjusts it on POST
+func (a *API) occupancy(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		a.post(OccupancyCommand)(w, r)
+		return
+	}
+
+	a.get(func() interface{} {
+		t := a.state.Totals()
+		return map[string]interface{}{
+			"time":      t.Time,
+			"occupancy": t.Occupancy,
+			"capacity":  t.Capacity,
+			"state":     t.State,
+			"baseline":  t.Baseline,
+		}
+	})(w, r)
+}
+
+// totals returns parking lot counters
+func (a *API) totals() interface{} {
+	return a.state.Totals()
+}
+
+// tracks returns tracked cars
+func (a *API) tracks() interface{} {
+	return a.state.Tracks()
+}
+
+// spaces returns map of parking spaces
+func (a *API) spaces() interface{} {
+	return a.state.Spaces()
+}
+
+// status returns status of the camera and publishing sinks
+func (a *API) status() interface{} {
+	camera := a.state.Camera()
+
+	status := map[string]interface{}{
+		"cameras": map[string]CameraStatus{camera.Name: camera},
+	}
+	if a.pub != nil {
+		status["sinks"] = a.pub.Status()
+	}
+
+	return status
+}
+
+// configuration returns program configuration with secrets redacted
+func (a *API) configuration() interface{} {
+	cfg := *a.config
+
+	if cfg.HTTP != nil && cfg.HTTP.Token != "" {
+		h := *cfg.HTTP
+		h.Token = redacted
+		cfg.HTTP = &h
+	}
+
+	cfg.Sinks = make([]*SinkConfig, len(a.config.Sinks))
+	for i, sc := range a.config.Sinks {
+		c := *sc
+		if c.Webhook != nil && c.Webhook.Secret != "" {
+			wc := *c.Webhook
+			wc.Secret = redacted
+			c.Webhook = &wc
+		}
+		cfg.Sinks[i] = &c
+	}
+
+	return &cfg
+}
+
+// writeJSON writes JSON encoded v to w with HTTP status code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Error encoding API response: %v\n", err)
+	}
+}
+
+// writeError writes JSON encoded err to w with HTTP status code
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,149 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// ClampCorrection is a correction of occupancy which fell out of the range between 0 and capacity
+	ClampCorrection = "clamp"
+	// ManeuverCorrection is a correction reverting the count of a car which made a wrong-way or U-turn maneuver
+	ManeuverCorrection = "maneuver"
+)
+
+// AuditConfig is configuration of audit trail of counter corrections
+type AuditConfig struct {
+	// Path is path to the file corrections are appended to; corrections are not saved if empty
+	Path string `json:"path"`
+}
+
+// Counts are parking lot counters before or after a correction
+type Counts struct {
+	// In is number of cars which entered the parking lot since the last reset
+	In int `json:"in"`
+	// Out is number of cars which left the parking lot since the last reset
+	Out int `json:"out"`
+	// Occupancy is number of cars parked in the parking lot
+	Occupancy int `json:"occupancy"`
+	// Baseline is occupancy baseline
+	Baseline int `json:"baseline"`
+}
+
+// Counts returns parking lot counters
+func (p *ParkingLot) Counts() Counts {
+	return Counts{
+		In:        p.TotalIn,
+		Out:       p.TotalOut,
+		Occupancy: p.Occupancy(),
+		Baseline:  p.Baseline,
+	}
+}
+
+// Correction is an event of parking lot counters being reset or corrected
+type Correction struct {
+	// Time is time of the correction
+	Time time.Time `json:"time"`
+	// Camera is name of the camera monitoring the parking lot
+	Camera string `json:"camera"`
+	// Action is the correction: reset, occupancy, clamp or maneuver
+	Action string `json:"action"`
+	// Source is what made the correction e.g. api or schedule
+	Source string `json:"source"`
+	// Reason is optional reason of the correction
+	Reason string `json:"reason,omitempty"`
+	// Before are the counters before the correction
+	Before Counts `json:"before"`
+	// After are the counters after the correction
+	After Counts `json:"after"`
+	// Delta is the change of occupancy
+	Delta int `json:"delta"`
+}
+
+// NewCorrection creates new correction of parking lot p counters by action from source and returns it.
+// before are the counters before the correction.
+func NewCorrection(action, source, reason string, before Counts, p *ParkingLot) *Correction {
+	after := p.Counts()
+
+	return &Correction{
+		Time:   time.Now(),
+		Camera: config.Camera,
+		Action: action,
+		Source: source,
+		Reason: reason,
+		Before: before,
+		After:  after,
+		Delta:  after.Occupancy - before.Occupancy,
+	}
+}
+
+// Audit appends corrections to a file, one JSON object per line.
+// Every correction is synced to disk before Record returns.
+type Audit struct {
+	// mu serializes writes to the file
+	mu sync.Mutex
+	// f is the audit trail file
+	f *os.File
+}
+
+// OpenAudit opens audit trail file in path for appending and returns it.
+// It returns error if the file can't be opened.
+func OpenAudit(path string) (*Audit, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Audit{f: f}, nil
+}
+
+// Record appends correction c to the audit trail
+// It returns error if the correction fails to be written.
+func (a *Audit) Record(c *Correction) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return a.f.Sync()
+}
+
+// Close closes the audit trail file
+func (a *Audit) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.f.Close()
+}
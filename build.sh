@@ -11,7 +11,7 @@ case "$LANG" in
             cmake .. && make
             ;;
         "go")
-            make dep && ln -s vendor/gocv.io/x/gocv/openvino/env.sh env.sh
+            make dep && ln -sf "$(go list -m -f '{{.Dir}}' gocv.io/x/gocv)/openvino/env.sh" env.sh
             source env.sh
             make
             ;;
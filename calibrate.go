@@ -0,0 +1,173 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+)
+
+// calibratePage is HTML page used to click calibration points on the camera snapshot
+const calibratePage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Speed calibration</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+#view { position: relative; display: inline-block; }
+#view canvas { position: absolute; left: 0; top: 0; }
+input { width: 6em; }
+</style>
+</head>
+<body>
+<h1>Speed calibration</h1>
+<p>Click four points on the ground, e.g. corners of a parking space, and enter their real-world coordinates in meters.</p>
+<div id="view"><img id="snapshot" src="/preview/snapshot.jpg"><canvas id="marks"></canvas></div>
+<table id="points"><tr><th>#</th><th>Pixel</th><th>X [m]</th><th>Y [m]</th></tr></table>
+<p>Token <input id="token" type="password"> <button id="save">Save</button> <button id="clear">Clear</button></p>
+<p id="status"></p>
+<script>
+var img = document.getElementById("snapshot"), canvas = document.getElementById("marks");
+var table = document.getElementById("points"), msg = document.getElementById("status");
+var frame = null, points = [];
+
+function draw() {
+  canvas.width = img.width; canvas.height = img.height;
+  var ctx = canvas.getContext("2d");
+  ctx.strokeStyle = ctx.fillStyle = "yellow";
+  ctx.lineWidth = 2;
+  ctx.beginPath();
+  points.forEach(function(p, i) {
+    var x = p[0] * img.width / frame.X, y = p[1] * img.height / frame.Y;
+    ctx.fillText(i + 1, x + 6, y - 6);
+    if (i == 0) { ctx.moveTo(x, y); } else { ctx.lineTo(x, y); }
+  });
+  if (points.length == 4) { ctx.closePath(); }
+  ctx.stroke();
+}
+
+function row(p, world) {
+  var tr = table.insertRow();
+  tr.insertCell().textContent = table.rows.length - 1;
+  tr.insertCell().textContent = p[0] + ", " + p[1];
+  [0, 1].forEach(function(k) {
+    var input = document.createElement("input");
+    input.type = "number"; input.step = "0.01"; input.value = world ? world[k] : "";
+    tr.insertCell().appendChild(input);
+  });
+}
+
+function clearPoints() {
+  points = [];
+  while (table.rows.length > 1) { table.deleteRow(1); }
+  draw();
+}
+
+canvas.addEventListener("click", function(e) {
+  if (!frame || points.length == 4) { return; }
+  var p = [Math.round(e.offsetX * frame.X / img.width), Math.round(e.offsetY * frame.Y / img.height)];
+  points.push(p);
+  row(p);
+  draw();
+});
+
+document.getElementById("clear").addEventListener("click", clearPoints);
+
+document.getElementById("save").addEventListener("click", function() {
+  var world = [];
+  for (var i = 1; i < table.rows.length; i++) {
+    var inputs = table.rows[i].getElementsByTagName("input");
+    world.push([parseFloat(inputs[0].value), parseFloat(inputs[1].value)]);
+  }
+  fetch("/api/calibration", {
+    method: "POST",
+    headers: {"Authorization": "Bearer " + document.getElementById("token").value},
+    body: JSON.stringify({image_points: points, world_points: world})
+  }).then(function(r) { return r.json(); }).then(function(res) {
+    msg.textContent = res.error ? "Error: " + res.error : "Calibration saved";
+  });
+});
+
+img.addEventListener("load", function() {
+  fetch("/api/calibration").then(function(r) { return r.json(); }).then(function(res) {
+    frame = res.frame;
+    clearPoints();
+    if (res.calibration) {
+      res.calibration.image_points.forEach(function(p, i) {
+        points.push(p);
+        row(p, res.calibration.world_points[i]);
+      });
+    }
+    draw();
+  });
+});
+</script>
+</body>
+</html>
+`
+
+// HandleCalibration registers calibration page and API of speed monitor s.
+// The calibration is served on GET requests to /api/calibration and replaced on POST requests.
+func (a *API) HandleCalibration(s *SpeedMonitor) {
+	a.mux.HandleFunc("/calibrate", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(calibratePage))
+	})
+
+	a.mux.HandleFunc("/api/calibration", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			a.get(func() interface{} {
+				c, frame := s.Calibration()
+				return map[string]interface{}{
+					"calibration": c,
+					"frame":       frame,
+				}
+			})(w, r)
+			return
+		}
+
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("Invalid or missing token"))
+			return
+		}
+
+		c := new(Calibration)
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(c); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid request body: %v", err))
+			return
+		}
+
+		if err := s.Calibrate(c); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		fmt.Printf("Speed calibration updated: %v -> %v\n", []image.Point(c.ImagePoints), c.WorldPoints)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"calibration": c})
+	})
+}
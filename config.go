@@ -0,0 +1,351 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+	// embedded time zone database used if the system one is missing
+	_ "time/tzdata"
+)
+
+// Config is program configuration read from JSON configuration file
+type Config struct {
+	// Site is the name of the site the counter is deployed at
+	Site string `json:"site"`
+	// Lot is the name of the monitored parking lot
+	Lot string `json:"lot"`
+	// Camera is the name of the camera monitoring the parking lot
+	Camera string `json:"camera"`
+	// Timezone is IANA time zone schedules are evaluated in e.g. Europe/London; defaults to local time zone
+	Timezone string `json:"timezone"`
+	// MQTT is MQTT publishing configuration
+	MQTT *MQTTConfig `json:"mqtt"`
+	// Sinks are sinks the analytics are published to; MQTT server is used if none are configured
+	Sinks []*SinkConfig `json:"sinks"`
+	// HTTP is embedded HTTP server configuration
+	HTTP *HTTPConfig `json:"http"`
+	// Preview is HTTP live preview configuration
+	Preview *PreviewConfig `json:"preview"`
+	// Recorder is annotated video recorder configuration
+	Recorder *RecorderConfig `json:"recorder"`
+	// Persist is parking lot state persistence configuration
+	Persist *PersistConfig `json:"persist"`
+	// Journal is event journal configuration
+	Journal *JournalConfig `json:"journal"`
+	// Occupancy is parking lot capacity and occupancy states configuration
+	Occupancy *OccupancyConfig `json:"occupancy"`
+	// Schedules are scheduled counter resets and occupancy reconciliations
+	Schedules []*ScheduleConfig `json:"schedules"`
+	// Audit is audit trail of counter corrections configuration
+	Audit *AuditConfig `json:"audit"`
+	// Aggregates is time-bucketed aggregate statistics configuration
+	Aggregates *AggregateConfig `json:"aggregates"`
+	// Dwell is dwell time measurement and gate blocking alerts configuration
+	Dwell *DwellConfig `json:"dwell"`
+	// WrongWay is wrong-way and U-turn detection configuration
+	WrongWay *WrongWayConfig `json:"wrong_way"`
+	// Speed is car speed estimation configuration
+	Speed *SpeedConfig `json:"speed"`
+	// Spaces is per-space occupancy detection configuration
+	Spaces *SpacesConfig `json:"spaces"`
+	// Gates is counting gates configuration
+	Gates *GatesConfig `json:"gates"`
+	// Zones is zone-based counting configuration
+	Zones *ZonesConfig `json:"zones"`
+	// ReID is re-identification of cars lost by tracking configuration
+	ReID *ReIDConfig `json:"reid"`
+	// Plausibility is suppression of pedestrians and other objects which are not cars configuration
+	Plausibility *PlausibilityConfig `json:"plausibility"`
+	// Queue is queue length measurement at the entry barrier configuration
+	Queue *QueueConfig `json:"queue"`
+	// location is time zone location
+	location *time.Location
+}
+
+// NewConfig returns configuration populated with default values
+func NewConfig() *Config {
+	return &Config{
+		Site:         "default",
+		Lot:          "default",
+		Camera:       "default",
+		MQTT:         NewMQTTConfig(),
+		HTTP:         &HTTPConfig{},
+		Preview:      &PreviewConfig{},
+		Recorder:     &RecorderConfig{},
+		Persist:      &PersistConfig{},
+		Journal:      &JournalConfig{},
+		Occupancy:    &OccupancyConfig{},
+		Audit:        &AuditConfig{},
+		Aggregates:   &AggregateConfig{},
+		Dwell:        &DwellConfig{},
+		WrongWay:     &WrongWayConfig{},
+		Speed:        &SpeedConfig{},
+		Spaces:       &SpacesConfig{},
+		Gates:        &GatesConfig{},
+		Zones:        &ZonesConfig{},
+		ReID:         &ReIDConfig{},
+		Plausibility: &PlausibilityConfig{},
+		Queue:        &QueueConfig{},
+	}
+}
+
+// LoadConfig reads JSON configuration from file in path and returns it.
+// Options missing in the file are set to their default values. If path is empty default configuration is returned.
+// It returns error if the file can't be read or parsed or if it contains invalid configuration.
+func LoadConfig(path string) (*Config, error) {
+	cfg := NewConfig()
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the configuration is valid and returns error if it is not
+func (c *Config) Validate() error {
+	names := map[string]string{"site": c.Site, "lot": c.Lot, "camera": c.Camera}
+	for key, val := range names {
+		if val == "" {
+			return fmt.Errorf("Invalid %s name: can't be empty", key)
+		}
+		if strings.ContainsAny(val, "/+#") {
+			return fmt.Errorf("Invalid %s name %q: can't contain any of /+#", key, val)
+		}
+	}
+
+	if c.MQTT == nil {
+		c.MQTT = NewMQTTConfig()
+	}
+
+	if err := c.MQTT.Validate(); err != nil {
+		return err
+	}
+
+	if c.HTTP == nil {
+		c.HTTP = &HTTPConfig{}
+	}
+
+	if err := c.HTTP.Validate(); err != nil {
+		return err
+	}
+
+	if c.Preview == nil {
+		c.Preview = &PreviewConfig{}
+	}
+
+	if err := c.Preview.Validate(); err != nil {
+		return err
+	}
+
+	if c.Recorder == nil {
+		c.Recorder = &RecorderConfig{}
+	}
+
+	if err := c.Recorder.Validate(); err != nil {
+		return err
+	}
+
+	if c.Persist == nil {
+		c.Persist = &PersistConfig{}
+	}
+
+	if err := c.Persist.Validate(); err != nil {
+		return err
+	}
+
+	if c.Journal == nil {
+		c.Journal = &JournalConfig{}
+	}
+
+	if c.Occupancy == nil {
+		c.Occupancy = &OccupancyConfig{}
+	}
+
+	if err := c.Occupancy.Validate(); err != nil {
+		return err
+	}
+
+	if c.Audit == nil {
+		c.Audit = &AuditConfig{}
+	}
+
+	if c.Aggregates == nil {
+		c.Aggregates = &AggregateConfig{}
+	}
+
+	if err := c.Aggregates.Validate(); err != nil {
+		return err
+	}
+
+	if c.Dwell == nil {
+		c.Dwell = &DwellConfig{}
+	}
+
+	if err := c.Dwell.Validate(); err != nil {
+		return err
+	}
+
+	if c.WrongWay == nil {
+		c.WrongWay = &WrongWayConfig{}
+	}
+
+	if err := c.WrongWay.Validate(); err != nil {
+		return err
+	}
+
+	if c.Speed == nil {
+		c.Speed = &SpeedConfig{}
+	}
+
+	if err := c.Speed.Validate(); err != nil {
+		return err
+	}
+
+	if c.Spaces == nil {
+		c.Spaces = &SpacesConfig{}
+	}
+
+	if err := c.Spaces.Validate(); err != nil {
+		return err
+	}
+
+	if c.Gates == nil {
+		c.Gates = &GatesConfig{}
+	}
+
+	if err := c.Gates.Validate(); err != nil {
+		return err
+	}
+
+	if c.Zones == nil {
+		c.Zones = &ZonesConfig{}
+	}
+
+	if err := c.Zones.Validate(); err != nil {
+		return err
+	}
+
+	// a car crossing a gate between two zones would be counted by both
+	if len(c.Gates.Gates) > 0 && len(c.Zones.Zones) > 0 {
+		return fmt.Errorf("Counting gates and zones can't be configured together")
+	}
+
+	if c.ReID == nil {
+		c.ReID = &ReIDConfig{}
+	}
+
+	if err := c.ReID.Validate(); err != nil {
+		return err
+	}
+
+	if c.Plausibility == nil {
+		c.Plausibility = &PlausibilityConfig{}
+	}
+
+	if err := c.Plausibility.Validate(); err != nil {
+		return err
+	}
+
+	if c.Queue == nil {
+		c.Queue = &QueueConfig{}
+	}
+
+	if err := c.Queue.Validate(); err != nil {
+		return err
+	}
+
+	c.location = time.Local
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return fmt.Errorf("Invalid time zone %q: %v", c.Timezone, err)
+		}
+		c.location = loc
+	}
+
+	for i, sc := range c.Schedules {
+		if sc == nil {
+			return fmt.Errorf("Invalid schedule %d: can't be empty", i)
+		}
+		if sc.Name == "" {
+			sc.Name = fmt.Sprintf("%s%d", sc.Command, i)
+		}
+		if err := sc.Validate(c.Timezone); err != nil {
+			return err
+		}
+	}
+
+	mqttSinks := 0
+	for i, sc := range c.Sinks {
+		if sc == nil {
+			return fmt.Errorf("Invalid sink %d: can't be empty", i)
+		}
+		if sc.Name == "" {
+			sc.Name = fmt.Sprintf("%s%d", sc.Type, i)
+		}
+		if err := sc.Validate(); err != nil {
+			return err
+		}
+		if sc.Type == "mqtt" {
+			mqttSinks++
+		}
+	}
+
+	if mqttSinks > 1 {
+		return fmt.Errorf("Only one mqtt sink can be configured")
+	}
+
+	return nil
+}
+
+// EntranceCounting returns true if cars are counted at the entrance set by -entrance flag,
+// i.e. when neither counting gates nor zones are configured
+func (c *Config) EntranceCounting() bool {
+	return len(c.Gates.Gates) == 0 && len(c.Zones.Zones) == 0
+}
+
+// Location returns configured time zone location
+func (c *Config) Location() *time.Location {
+	if c.location == nil {
+		return time.Local
+	}
+
+	return c.location
+}
@@ -0,0 +1,315 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DwellConfig is configuration of dwell time measurement, gate blocking and no parking alerts
+type DwellConfig struct {
+	// StillSpeed is speed in pixels per second below which a car is considered standing still; defaults to 10
+	StillSpeed float64 `json:"still_speed"`
+	// Gate is polygon of the gate area; gate blocking alerts are disabled if empty
+	Gate Polygon `json:"gate"`
+	// BlockTime is number of seconds a car must stand still in the gate to raise an alert; defaults to 30
+	BlockTime float64 `json:"block_time"`
+	// NoParking are no parking zones; no parking alerts are disabled if empty
+	NoParking []*ZoneConfig `json:"no_parking"`
+	// LoiterTime is number of seconds a car must stand still in a no parking zone to raise an alert; defaults to 60
+	LoiterTime float64 `json:"loiter_time"`
+}
+
+// Validate checks dwell configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *DwellConfig) Validate() error {
+	if c.StillSpeed < 0 {
+		return fmt.Errorf("Invalid still speed: %f", c.StillSpeed)
+	}
+	if c.StillSpeed == 0 {
+		c.StillSpeed = 10
+	}
+
+	if len(c.Gate) > 0 {
+		if err := c.Gate.Validate(); err != nil {
+			return fmt.Errorf("Invalid gate: %v", err)
+		}
+	}
+
+	if c.BlockTime < 0 {
+		return fmt.Errorf("Invalid block time: %f", c.BlockTime)
+	}
+	if c.BlockTime == 0 {
+		c.BlockTime = 30
+	}
+
+	for i, z := range c.NoParking {
+		if z == nil || z.Name == "" {
+			return fmt.Errorf("Invalid no parking zone %d: name can't be empty", i)
+		}
+		if err := z.Polygon.Validate(); err != nil {
+			return fmt.Errorf("Invalid no parking zone %s: %v", z.Name, err)
+		}
+	}
+
+	if c.LoiterTime < 0 {
+		return fmt.Errorf("Invalid loiter time: %f", c.LoiterTime)
+	}
+	if c.LoiterTime == 0 {
+		c.LoiterTime = 60
+	}
+
+	return nil
+}
+
+// Dwell is an event of a tracked car leaving the camera view with the time it spent in the view
+type Dwell struct {
+	// Time is time the track ended
+	Time time.Time `json:"time"`
+	// Camera is name of the camera which tracked the car
+	Camera string `json:"camera"`
+	// TrackID is ID of the tracked car
+	TrackID uuid.UUID `json:"track_id"`
+	// Start is time the car was first seen
+	Start time.Time `json:"start"`
+	// End is time the car was last seen
+	End time.Time `json:"end"`
+	// Dwell is number of seconds the car was tracked for
+	Dwell float64 `json:"dwell"`
+	// Still is number of seconds the car was standing still
+	Still float64 `json:"still"`
+	// Moving is number of seconds the car was moving
+	Moving float64 `json:"moving"`
+	// Counted is true if the car was counted in or out
+	Counted bool `json:"counted"`
+}
+
+// loitering is a car standing still in a no parking zone
+type loitering struct {
+	// zone is name of the no parking zone
+	zone string
+	// since is time the car stopped at
+	since time.Time
+}
+
+// dwellTrack is dwell state of a tracked car updated with the trajectory points added since the previous frame
+type dwellTrack struct {
+	// car is the tracked car
+	car *Car
+	// start is time the car was first seen
+	start time.Time
+	// last is time of the last trajectory point processed
+	last time.Time
+	// point is the last trajectory point processed
+	point image.Point
+	// still is number of seconds the car was standing still
+	still float64
+	// moving is number of seconds the car was moving
+	moving float64
+	// stopped is time since which the car has been standing still; time of its last point if it's moving
+	stopped time.Time
+	// lost is time the car was lost by tracking at; zero if it's tracked
+	lost time.Time
+}
+
+// DwellMonitor measures dwell time of tracked cars and raises alerts when they block the gate
+// or stand still in a no parking zone. It is not safe for concurrent use.
+type DwellMonitor struct {
+	// config is dwell configuration
+	config *DwellConfig
+	// tracks are dwell states of the cars tracked in the previous frame
+	tracks map[uuid.UUID]*dwellTrack
+	// blocking are times the cars blocking the gate stopped at
+	blocking map[uuid.UUID]time.Time
+	// loitering are the cars standing still in no parking zones
+	loitering map[uuid.UUID]*loitering
+	// maxLost is number of seconds tracks of the cars lost by tracking are kept for
+	maxLost float64
+}
+
+// NewDwellMonitor creates new dwell monitor configured in dc and returns it.
+// Tracks of the cars lost by tracking are kept for maxLost seconds, so that they go on when the cars
+// are re-identified, e.g. after being hidden by a passing truck.
+func NewDwellMonitor(dc *DwellConfig, maxLost float64) *DwellMonitor {
+	return &DwellMonitor{
+		config:    dc,
+		maxLost:   maxLost,
+		tracks:    make(map[uuid.UUID]*dwellTrack),
+		blocking:  make(map[uuid.UUID]time.Time),
+		loitering: make(map[uuid.UUID]*loitering),
+	}
+}
+
+// Update updates the monitor with cars tracked in a frame processed at time t.
+// It returns dwell events of the cars which are no longer tracked and raised and cleared gate blocking
+// and no parking alerts. A car lost by tracking is no longer tracked once it hasn't been re-identified
+// for max lost seconds; its alerts stay raised until then.
+func (m *DwellMonitor) Update(t time.Time, cars CarMap) ([]*Dwell, []*Alert) {
+	var dwells []*Dwell
+	var alerts []*Alert
+
+	for id, tr := range m.tracks {
+		if _, ok := cars[id]; ok {
+			tr.lost = time.Time{}
+			continue
+		}
+		if tr.lost.IsZero() {
+			tr.lost = t
+		}
+		if m.maxLost > 0 && t.Sub(tr.lost).Seconds() <= m.maxLost {
+			continue
+		}
+		car := tr.car
+		dwells = append(dwells, m.dwell(tr, t))
+		delete(m.tracks, id)
+		if since, ok := m.blocking[id]; ok {
+			alerts = append(alerts, NewCarAlert(GateBlockedAlert, false, car, since, t))
+			delete(m.blocking, id)
+		}
+		if l, ok := m.loitering[id]; ok {
+			alerts = append(alerts, m.noParkingAlert(false, car, l, t))
+			delete(m.loitering, id)
+		}
+	}
+
+	for id, car := range cars {
+		if len(car.Traject) == 0 {
+			continue
+		}
+		tr, ok := m.tracks[id]
+		if !ok {
+			tr = &dwellTrack{start: car.Times[0], last: car.Times[0], point: car.Traject[0], stopped: car.Times[0]}
+			m.tracks[id] = tr
+		}
+		tr.car = car
+		m.advance(tr)
+		if len(m.config.Gate) == 0 && len(m.config.NoParking) == 0 {
+			continue
+		}
+
+		stopped := tr.stopped
+		p := car.Traject[len(car.Traject)-1]
+		if len(m.config.Gate) > 0 {
+			since, blocked := m.blocking[id]
+			inGate := m.config.Gate.Contains(p)
+			switch {
+			case !blocked && inGate && t.Sub(stopped).Seconds() >= m.config.BlockTime:
+				m.blocking[id] = stopped
+				alerts = append(alerts, NewCarAlert(GateBlockedAlert, true, car, stopped, t))
+			case blocked && (!inGate || stopped.After(since)):
+				alerts = append(alerts, NewCarAlert(GateBlockedAlert, false, car, since, t))
+				delete(m.blocking, id)
+			}
+		}
+
+		if len(m.config.NoParking) > 0 {
+			zone := m.noParkingZone(p)
+			l, loiters := m.loitering[id]
+			switch {
+			case !loiters && zone != "" && t.Sub(stopped).Seconds() >= m.config.LoiterTime:
+				m.loitering[id] = &loitering{zone: zone, since: stopped}
+				alerts = append(alerts, m.noParkingAlert(true, car, m.loitering[id], t))
+			case loiters && zone != l.zone:
+				alerts = append(alerts, m.noParkingAlert(false, car, l, t))
+				delete(m.loitering, id)
+			}
+		}
+	}
+
+	return dwells, alerts
+}
+
+// noParkingZone returns name of the first no parking zone which contains p or empty string if there is none
+func (m *DwellMonitor) noParkingZone(p image.Point) string {
+	for _, z := range m.config.NoParking {
+		if z.Polygon.Contains(p) {
+			return z.Name
+		}
+	}
+
+	return ""
+}
+
+// noParkingAlert returns no parking alert caused by car loitering in a no parking zone at time t.
+// The alert is raised if active is true and cleared otherwise.
+func (m *DwellMonitor) noParkingAlert(active bool, car *Car, l *loitering, t time.Time) *Alert {
+	a := NewCarAlert(NoParkingAlert, active, car, l.since, t)
+	a.Zone = l.zone
+
+	return a
+}
+
+// still returns true if a car moved slower than still speed from point p to point q in dt seconds
+func (m *DwellMonitor) still(p, q image.Point, dt float64) bool {
+	if dt <= 0 {
+		return true
+	}
+
+	return dist(p, q)/dt < m.config.StillSpeed
+}
+
+// advance updates dwell track tr with the trajectory points added to its car since tr was last updated.
+// The points of the frames the car wasn't detected in are skipped, so that the time the car was missed for
+// is accounted for when it's detected again and not at all if it's never detected again.
+func (m *DwellMonitor) advance(tr *dwellTrack) {
+	car := tr.car
+	i := len(car.Times)
+	for i > 0 && car.Times[i-1].After(tr.last) {
+		i--
+	}
+
+	for ; i < len(car.Times); i++ {
+		if !car.detected[i] {
+			continue
+		}
+		dt := car.Times[i].Sub(tr.last).Seconds()
+		if m.still(tr.point, car.Traject[i], dt) {
+			tr.still += dt
+		} else {
+			tr.moving += dt
+			tr.stopped = car.Times[i]
+		}
+		tr.last = car.Times[i]
+		tr.point = car.Traject[i]
+	}
+}
+
+// dwell returns dwell event of the car of track tr which is no longer tracked at time t
+func (m *DwellMonitor) dwell(tr *dwellTrack, t time.Time) *Dwell {
+	return &Dwell{
+		Time:    t,
+		Camera:  config.Camera,
+		TrackID: tr.car.ID,
+		Start:   tr.start,
+		End:     tr.last,
+		Dwell:   tr.last.Sub(tr.start).Seconds(),
+		Still:   tr.still,
+		Moving:  tr.moving,
+		Counted: tr.car.counted,
+	}
+}
@@ -0,0 +1,83 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FileSinkConfig is configuration of file sink
+type FileSinkConfig struct {
+	// Path is path to the file messages are appended to
+	Path string `json:"path"`
+}
+
+// FileSink appends published messages to a local file, one JSON object per line
+type FileSink struct {
+	// mu serializes writes to the file
+	mu sync.Mutex
+	// f is the file messages are written to
+	f *os.File
+	// config is program configuration
+	config *Config
+}
+
+// NewFileSink opens the file configured in fc for appending and returns new file sink.
+// Messages are written along with site, lot and camera names from cfg.
+// It returns error if the file can't be opened.
+func NewFileSink(cfg *Config, fc *FileSinkConfig) (*FileSink, error) {
+	f, err := os.OpenFile(fc.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{f: f, config: cfg}, nil
+}
+
+// Publish appends message m to the file
+// It returns error if the message fails to be written.
+func (s *FileSink) Publish(ctx context.Context, m *Message) error {
+	data, err := json.Marshal(newEnvelope(s.config, m))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.f.Write(append(data, '\n'))
+
+	return err
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
@@ -0,0 +1,262 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// formulaTerm matches a term of lot occupancy formula e.g. -exit.out
+var formulaTerm = regexp.MustCompile(`^([+-])([^\s+.-]+)\.(in|out)$`)
+
+// GateConfig is configuration of a counting gate
+type GateConfig struct {
+	// Name is gate name e.g. entry
+	Name string `json:"name"`
+	// Line are the two end points of the gate line in frame pixel coordinates
+	Line [2][2]int `json:"line"`
+	// Inside is a point on the inner side of the gate line; cars crossing towards it are counted in
+	Inside [2]int `json:"inside"`
+}
+
+// GatesConfig is configuration of counting gates
+type GatesConfig struct {
+	// Gates are counting gates; cars are counted at the entrance set by -entrance flag if empty
+	Gates []*GateConfig `json:"gates"`
+	// Formula is sum of gate counters lot occupancy changes by e.g. "entry.in - exit.out";
+	// defaults to in minus out of all gates
+	Formula string `json:"formula"`
+	// Margin is number of pixels a car must be away from gate line to be on its side; defaults to 5
+	Margin float64 `json:"margin"`
+	// terms are signs of gate counters in the formula keyed by gate name and direction
+	terms map[string]map[string]int
+}
+
+// Validate checks gates configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *GatesConfig) Validate() error {
+	if len(c.Gates) == 0 {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for i, g := range c.Gates {
+		if g == nil || g.Name == "" {
+			return fmt.Errorf("Invalid gate %d: name can't be empty", i)
+		}
+		if strings.ContainsAny(g.Name, " +-.") {
+			return fmt.Errorf("Invalid gate name %q: can't contain any of +-. or spaces", g.Name)
+		}
+		if names[g.Name] {
+			return fmt.Errorf("Duplicate gate %s", g.Name)
+		}
+		names[g.Name] = true
+		if g.Line[0] == g.Line[1] {
+			return fmt.Errorf("Invalid line of gate %s: end points must differ", g.Name)
+		}
+		if g.side(image.Pt(g.Inside[0], g.Inside[1]), 0) == 0 {
+			return fmt.Errorf("Invalid inside point of gate %s: must not lie on the gate line", g.Name)
+		}
+	}
+
+	if c.Formula == "" {
+		terms := make([]string, len(c.Gates))
+		for i, g := range c.Gates {
+			terms[i] = fmt.Sprintf("%s.in - %s.out", g.Name, g.Name)
+		}
+		c.Formula = strings.Join(terms, " + ")
+	}
+
+	terms, err := parseFormula(c.Formula, names)
+	if err != nil {
+		return err
+	}
+	c.terms = terms
+
+	if c.Margin < 0 {
+		return fmt.Errorf("Invalid gate margin: %f", c.Margin)
+	}
+	if c.Margin == 0 {
+		c.Margin = 5
+	}
+
+	return nil
+}
+
+// parseFormula parses lot occupancy formula over gates with names.
+// It returns signs of gate counters keyed by gate name and direction or error if the formula is invalid.
+func parseFormula(formula string, names map[string]bool) (map[string]map[string]int, error) {
+	s := strings.Join(strings.Fields(formula), "")
+	if !strings.HasPrefix(s, "+") && !strings.HasPrefix(s, "-") {
+		s = "+" + s
+	}
+
+	terms := make(map[string]map[string]int)
+	for len(s) > 0 {
+		end := strings.IndexAny(s[1:], "+-") + 1
+		if end == 0 {
+			end = len(s)
+		}
+		m := formulaTerm.FindStringSubmatch(s[:end])
+		if m == nil {
+			return nil, fmt.Errorf("Invalid occupancy formula %q: invalid term %q", formula, s[:end])
+		}
+		if !names[m[2]] {
+			return nil, fmt.Errorf("Invalid occupancy formula %q: unknown gate %s", formula, m[2])
+		}
+		if terms[m[2]] == nil {
+			terms[m[2]] = make(map[string]int)
+		}
+		if _, ok := terms[m[2]][m[3]]; ok {
+			return nil, fmt.Errorf("Invalid occupancy formula %q: duplicate term %s.%s", formula, m[2], m[3])
+		}
+		terms[m[2]][m[3]] = 1
+		if m[1] == "-" {
+			terms[m[2]][m[3]] = -1
+		}
+		s = s[end:]
+	}
+
+	return terms, nil
+}
+
+// side returns 1 or -1 depending on which side of the gate line point p lies.
+// It returns 0 if the point is closer to the line than margin pixels.
+func (g *GateConfig) side(p image.Point, margin float64) int {
+	ax, ay := float64(g.Line[0][0]), float64(g.Line[0][1])
+	bx, by := float64(g.Line[1][0]), float64(g.Line[1][1])
+
+	// signed distance of the point from the line
+	d := ((bx-ax)*(float64(p.Y)-ay) - (by-ay)*(float64(p.X)-ax)) / math.Hypot(bx-ax, by-ay)
+	switch {
+	case d > margin:
+		return 1
+	case d < -margin:
+		return -1
+	}
+
+	return 0
+}
+
+// crosses returns true if the path from point p to point q crosses the gate line between its end points
+func (g *GateConfig) crosses(p, q image.Point) bool {
+	ax, ay := float64(g.Line[0][0]), float64(g.Line[0][1])
+	bx, by := float64(g.Line[1][0]), float64(g.Line[1][1])
+	rx, ry := float64(q.X-p.X), float64(q.Y-p.Y)
+
+	denom := (bx-ax)*ry - (by-ay)*rx
+	if denom == 0 {
+		return false
+	}
+	// position of the intersection along the gate line
+	u := ((float64(p.X)-ax)*ry - (float64(p.Y)-ay)*rx) / denom
+
+	return u >= 0 && u <= 1
+}
+
+// GateTotals are counters of a gate
+type GateTotals struct {
+	// In is number of cars which crossed the gate in
+	In int `json:"in"`
+	// Out is number of cars which crossed the gate out
+	Out int `json:"out"`
+}
+
+// gatePosition is the last position of a car registered on one side of a gate
+type gatePosition struct {
+	// side is the side of the gate line
+	side int
+	// point is the car position
+	point image.Point
+}
+
+// UpdateGates updates gate and parking lot counters using the cars tracked across gates configured in gc.
+// Lot counters change according to the gates occupancy formula.
+// It returns crossing events of the cars which crossed any of the gates.
+func (p *ParkingLot) UpdateGates(cars CarMap, gc *GatesConfig) []*Crossing {
+	if p.Gates == nil {
+		p.Gates = make(map[string]*GateTotals)
+	}
+
+	var crossings []*Crossing
+	for _, car := range cars {
+		if car.gates == nil {
+			car.gates = make(map[string]*gatePosition)
+		}
+		pt := car.Traject[len(car.Traject)-1]
+
+		for _, g := range gc.Gates {
+			side := g.side(pt, gc.Margin)
+			if side == 0 {
+				continue
+			}
+
+			last, ok := car.gates[g.Name]
+			car.gates[g.Name] = &gatePosition{side: side, point: pt}
+			if !ok || last.side == side || !g.crosses(last.point, pt) {
+				continue
+			}
+
+			dir := DirOut
+			if side == g.side(image.Pt(g.Inside[0], g.Inside[1]), 0) {
+				dir = DirIn
+			}
+			crossings = append(crossings, p.countGate(car, g.Name, dir, gc.terms[g.Name][dir]))
+		}
+	}
+
+	return crossings
+}
+
+// countGate counts car crossing gate in direction dir and returns the crossing event.
+// Lot counters change by sign of the gate counter in the occupancy formula.
+func (p *ParkingLot) countGate(car *Car, gate, dir string, sign int) *Crossing {
+	if p.Gates[gate] == nil {
+		p.Gates[gate] = &GateTotals{}
+	}
+
+	if dir == DirIn {
+		p.Gates[gate].In++
+	} else {
+		p.Gates[gate].Out++
+	}
+	car.counted = true
+
+	c := NewCrossing(car, dir)
+	c.Gate = gate
+	switch sign {
+	case 1:
+		p.TotalIn++
+		c.Lot = DirIn
+	case -1:
+		p.TotalOut++
+		c.Lot = DirOut
+	}
+
+	return c
+}
@@ -0,0 +1,209 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestParseFormula(t *testing.T) {
+	names := map[string]bool{"entry": true, "exit": true, "ramp": true}
+
+	tests := []struct {
+		formula string
+		want    map[string]map[string]int
+		fail    bool
+	}{
+		{"entry.in - exit.out", map[string]map[string]int{"entry": {"in": 1}, "exit": {"out": -1}}, false},
+		{"-ramp.in+ramp.out", map[string]map[string]int{"ramp": {"in": -1, "out": 1}}, false},
+		{"  + entry.in  -  entry.out ", map[string]map[string]int{"entry": {"in": 1, "out": -1}}, false},
+		{"", nil, true},
+		{"entry.in -", nil, true},
+		{"entry.in -- exit.out", nil, true},
+		{"entry.in exit.out", nil, true},
+		{"entry.up", nil, true},
+		{"entry", nil, true},
+		{"2 * entry.in", nil, true},
+		{"lobby.in", nil, true},
+		{"entry.in + entry.in", nil, true},
+		{"entry.in - entry.in", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseFormula(tt.formula, names)
+		if (err != nil) != tt.fail {
+			t.Errorf("parseFormula(%q) error = %v, want failure %v", tt.formula, err, tt.fail)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFormula(%q) = %v, want %v", tt.formula, got, tt.want)
+		}
+	}
+}
+
+func TestGatesConfigValidate(t *testing.T) {
+	gate := func(name string) *GateConfig {
+		return &GateConfig{Name: name, Line: [2][2]int{{0, 100}, {200, 100}}, Inside: [2]int{100, 0}}
+	}
+
+	tests := []struct {
+		name    string
+		config  GatesConfig
+		formula string
+		fail    bool
+	}{
+		{"default formula", GatesConfig{Gates: []*GateConfig{gate("entry"), gate("exit")}},
+			"entry.in - entry.out + exit.in - exit.out", false},
+		{"custom formula", GatesConfig{Gates: []*GateConfig{gate("entry"), gate("exit")}, Formula: "entry.in - exit.out"},
+			"entry.in - exit.out", false},
+		{"invalid formula", GatesConfig{Gates: []*GateConfig{gate("entry")}, Formula: "entry.in + exit.out"}, "", true},
+		{"invalid name", GatesConfig{Gates: []*GateConfig{gate("sub-level")}}, "", true},
+		{"duplicate name", GatesConfig{Gates: []*GateConfig{gate("entry"), gate("entry")}}, "", true},
+		{"empty line", GatesConfig{Gates: []*GateConfig{{Name: "entry", Line: [2][2]int{{5, 5}, {5, 5}}}}}, "", true},
+		{"inside on line", GatesConfig{Gates: []*GateConfig{
+			{Name: "entry", Line: [2][2]int{{0, 100}, {200, 100}}, Inside: [2]int{300, 100}}}}, "", true},
+		{"negative margin", GatesConfig{Gates: []*GateConfig{gate("entry")}, Margin: -1}, "", true},
+	}
+
+	for _, tt := range tests {
+		c := tt.config
+		err := c.Validate()
+		if (err != nil) != tt.fail {
+			t.Errorf("%s: Validate() error = %v, want failure %v", tt.name, err, tt.fail)
+			continue
+		}
+		if err == nil && c.Formula != tt.formula {
+			t.Errorf("%s: formula = %q, want %q", tt.name, c.Formula, tt.formula)
+		}
+	}
+}
+
+func TestGateSide(t *testing.T) {
+	g := &GateConfig{Line: [2][2]int{{0, 100}, {200, 100}}}
+
+	tests := []struct {
+		p      image.Point
+		margin float64
+		want   int
+	}{
+		{image.Pt(100, 150), 5, 1},
+		{image.Pt(100, 50), 5, -1},
+		{image.Pt(100, 103), 5, 0},
+		{image.Pt(100, 103), 0, 1},
+		{image.Pt(100, 100), 0, 0},
+		{image.Pt(500, 150), 5, 1},
+	}
+
+	for _, tt := range tests {
+		if got := g.side(tt.p, tt.margin); got != tt.want {
+			t.Errorf("side(%v, %f) = %d, want %d", tt.p, tt.margin, got, tt.want)
+		}
+	}
+}
+
+func TestGateCrosses(t *testing.T) {
+	g := &GateConfig{Line: [2][2]int{{0, 100}, {200, 100}}}
+
+	tests := []struct {
+		name string
+		p, q image.Point
+		want bool
+	}{
+		{"across the middle", image.Pt(100, 50), image.Pt(100, 150), true},
+		{"diagonally", image.Pt(20, 20), image.Pt(180, 180), true},
+		{"through end point", image.Pt(200, 50), image.Pt(200, 150), true},
+		{"beyond end point", image.Pt(250, 50), image.Pt(250, 150), false},
+		{"before start point", image.Pt(-10, 50), image.Pt(-10, 150), false},
+		{"parallel", image.Pt(0, 50), image.Pt(200, 50), false},
+		{"along the line", image.Pt(0, 100), image.Pt(200, 100), false},
+		{"standing still", image.Pt(100, 50), image.Pt(100, 50), false},
+	}
+
+	for _, tt := range tests {
+		if got := g.crosses(tt.p, tt.q); got != tt.want {
+			t.Errorf("%s: crosses(%v, %v) = %v, want %v", tt.name, tt.p, tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateGates(t *testing.T) {
+	config = NewConfig()
+	gc := &GatesConfig{
+		Gates: []*GateConfig{
+			{Name: "entry", Line: [2][2]int{{0, 100}, {200, 100}}, Inside: [2]int{100, 0}},
+			{Name: "ramp", Line: [2][2]int{{300, 0}, {300, 200}}, Inside: [2]int{400, 100}},
+		},
+		Formula: "entry.in - entry.out - ramp.in + ramp.out",
+	}
+	if err := gc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		traject  []image.Point
+		gate     string
+		dir      string
+		lot      string
+		crossing bool
+	}{
+		{"entering", []image.Point{{100, 150}, {100, 102}, {100, 50}}, "entry", DirIn, DirIn, true},
+		{"leaving", []image.Point{{100, 50}, {100, 150}}, "entry", DirOut, DirOut, true},
+		{"down the ramp", []image.Point{{250, 100}, {350, 100}}, "ramp", DirIn, DirOut, true},
+		{"within margin", []image.Point{{100, 150}, {100, 98}, {100, 150}}, "", "", "", false},
+		{"around the gate", []image.Point{{250, 150}, {250, 50}}, "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ParkingLot{}
+			car := &Car{}
+			var crossings []*Crossing
+			for _, pt := range tt.traject {
+				car.Traject = append(car.Traject, pt)
+				crossings = append(crossings, p.UpdateGates(CarMap{car.ID: car}, gc)...)
+			}
+
+			if !tt.crossing {
+				if len(crossings) != 0 {
+					t.Errorf("UpdateGates() = %d crossings, want none", len(crossings))
+				}
+				return
+			}
+			if len(crossings) != 1 {
+				t.Fatalf("UpdateGates() = %d crossings, want 1", len(crossings))
+			}
+			c := crossings[0]
+			if c.Gate != tt.gate || c.Direction != tt.dir || c.Lot != tt.lot {
+				t.Errorf("crossing = %s %s counted %s, want %s %s counted %s", c.Gate, c.Direction, c.Lot,
+					tt.gate, tt.dir, tt.lot)
+			}
+			if p.Occupancy() != map[string]int{DirIn: 1, DirOut: -1}[tt.lot] {
+				t.Errorf("occupancy = %d after crossing counted %s", p.Occupancy(), tt.lot)
+			}
+		})
+	}
+}
@@ -0,0 +1,595 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	// registers sqlite3 database driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// schema creates journal database tables
+const schema = `
+CREATE TABLE IF NOT EXISTS crossings (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time INTEGER NOT NULL,
+	camera TEXT NOT NULL,
+	track_id TEXT NOT NULL,
+	direction TEXT NOT NULL,
+	class TEXT NOT NULL,
+	confidence REAL NOT NULL,
+	trajectory TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS crossings_time ON crossings (time);
+CREATE TABLE IF NOT EXISTS aggregates (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	camera TEXT NOT NULL,
+	interval TEXT NOT NULL,
+	start_time INTEGER NOT NULL,
+	end_time INTEGER NOT NULL,
+	cars_in INTEGER NOT NULL,
+	cars_out INTEGER NOT NULL,
+	peak INTEGER NOT NULL,
+	mean REAL NOT NULL,
+	occupancy INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS aggregates_start ON aggregates (interval, start_time);
+`
+
+// migrations are columns added to journal tables after they were first created
+var migrations = []struct {
+	// table is table name
+	table string
+	// column is column name
+	column string
+	// definition is column definition
+	definition string
+}{
+	{"crossings", "gate", "TEXT NOT NULL DEFAULT ''"},
+	{"crossings", "lot", "TEXT NOT NULL DEFAULT ''"},
+	{"crossings", "from_zone", "TEXT NOT NULL DEFAULT ''"},
+	{"crossings", "to_zone", "TEXT NOT NULL DEFAULT ''"},
+	{"crossings", "revert", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// missingColumns returns migrated columns missing in tables of journal database db keyed by table.column
+func missingColumns(db *sql.DB) (map[string]bool, error) {
+	missing := make(map[string]bool)
+	for _, m := range migrations {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, m.table,
+			m.column).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			missing[m.table+"."+m.column] = true
+		}
+	}
+
+	return missing, nil
+}
+
+// migrate adds columns missing in tables of journal database db
+func migrate(db *sql.DB) error {
+	missing, err := missingColumns(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if !missing[m.table+"."+m.column] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column,
+			m.definition)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// JournalConfig is configuration of event journal
+type JournalConfig struct {
+	// Path is path to SQLite database file events are written to; events are not journaled if empty
+	Path string `json:"path"`
+}
+
+// Journal writes crossing events and aggregate statistics to local SQLite database.
+// Events are written from a separate goroutine so that slow disk does not hold up video processing.
+type Journal struct {
+	// db is journal database
+	db *sql.DB
+	// queue buffers events waiting to be written
+	queue chan *journalBatch
+	// done is closed when all queued events are written
+	done chan struct{}
+	// missing are columns missing in read-only journal database keyed by table.column
+	missing map[string]bool
+}
+
+// OpenJournal opens journal database in path creating it if it doesn't exist and starts its writing goroutine.
+// It returns error if the database can't be opened or created.
+func OpenJournal(path string) (*Journal, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to create journal database %s: %v", path, err)
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to migrate journal database %s: %v", path, err)
+	}
+
+	j := &Journal{
+		db:    db,
+		queue: make(chan *journalBatch, QUEUE),
+		done:  make(chan struct{}),
+	}
+
+	go j.run()
+
+	return j, nil
+}
+
+// OpenJournalReadOnly opens existing journal database in path for querying only.
+// The database is neither created nor migrated; columns missing in databases of older versions read as their defaults.
+// It returns error if the database can't be opened.
+func OpenJournalReadOnly(path string) (*Journal, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	missing, err := missingColumns(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to read journal database %s: %v", path, err)
+	}
+
+	return &Journal{db: db, missing: missing}, nil
+}
+
+// column returns expression selecting column of table, which is its default value if the column is missing
+func (j *Journal) column(table, column string) string {
+	if !j.missing[table+"."+column] {
+		return column
+	}
+
+	for _, m := range migrations {
+		if m.table == table && m.column == column {
+			return m.definition[strings.Index(m.definition, "DEFAULT ")+len("DEFAULT "):]
+		}
+	}
+
+	return column
+}
+
+// run writes queued events to the database until the journal is closed
+func (j *Journal) run() {
+	defer close(j.done)
+
+	for b := range j.queue {
+		if err := j.insert(b); err != nil {
+			fmt.Printf("Error writing %d events and %d aggregates to journal: %v\n", len(b.crossings),
+				len(b.aggregates), err)
+		}
+	}
+}
+
+// journalBatch are records written to the journal in a single transaction
+type journalBatch struct {
+	// crossings are crossing events
+	crossings []*Crossing
+	// aggregates are aggregate statistics
+	aggregates []*Aggregate
+}
+
+// Record queues crossings to be written to the journal.
+// It blocks if the queue is full so that no event is lost.
+func (j *Journal) Record(crossings []*Crossing) {
+	if len(crossings) == 0 {
+		return
+	}
+
+	j.queue <- &journalBatch{crossings: crossings}
+}
+
+// RecordAggregates queues aggregates to be written to the journal.
+// It blocks if the queue is full so that no aggregate is lost.
+func (j *Journal) RecordAggregates(aggregates []*Aggregate) {
+	if len(aggregates) == 0 {
+		return
+	}
+
+	j.queue <- &journalBatch{aggregates: aggregates}
+}
+
+// insert writes batch b to the database in a single transaction
+func (j *Journal) insert(b *journalBatch) error {
+	tx, err := j.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := insertCrossings(tx, b.crossings); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := insertAggregates(tx, b.aggregates); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertCrossings writes crossings to the database in transaction tx
+func insertCrossings(tx *sql.Tx, crossings []*Crossing) error {
+	if len(crossings) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO crossings (time, camera, track_id, direction, class, confidence, trajectory,
+		gate, lot, from_zone, to_zone, revert) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, c := range crossings {
+		traject, err := json.Marshal(c.Traject)
+		if err != nil {
+			return err
+		}
+
+		if _, err := stmt.Exec(toMillis(c.Time), c.Camera, c.TrackID.String(), c.Direction, c.Class,
+			c.Confidence, string(traject), c.Gate, c.Lot, c.From, c.To, c.Revert); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertAggregates writes aggregates to the database in transaction tx
+func insertAggregates(tx *sql.Tx, aggregates []*Aggregate) error {
+	if len(aggregates) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO aggregates (camera, interval, start_time, end_time, cars_in, cars_out, peak, mean,
+		occupancy) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, a := range aggregates {
+		if _, err := stmt.Exec(a.Camera, a.Interval, toMillis(a.Start), toMillis(a.End), a.In, a.Out, a.Peak,
+			a.Mean, a.Occupancy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Query returns crossings of camera recorded from time from until time to ordered by time.
+// If camera is empty, crossings of all cameras are returned.
+// It returns error if the database query fails.
+func (j *Journal) Query(from, to time.Time, camera string) ([]*Crossing, error) {
+	rows, err := j.db.Query(fmt.Sprintf(`SELECT time, camera, track_id, direction, class, confidence, trajectory,
+		%s, %s, %s, %s, %s FROM crossings WHERE time >= ? AND time < ? AND (? = '' OR camera = ?) ORDER BY time, id`,
+		j.column("crossings", "gate"), j.column("crossings", "lot"), j.column("crossings", "from_zone"),
+		j.column("crossings", "to_zone"), j.column("crossings", "revert")),
+		toMillis(from), toMillis(to), camera, camera)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var crossings []*Crossing
+	for rows.Next() {
+		var ms int64
+		var id, traject string
+		c := new(Crossing)
+		if err := rows.Scan(&ms, &c.Camera, &id, &c.Direction, &c.Class, &c.Confidence, &traject, &c.Gate,
+			&c.Lot, &c.From, &c.To, &c.Revert); err != nil {
+			return nil, err
+		}
+		c.Time = time.Unix(0, ms*int64(time.Millisecond))
+		if c.TrackID, err = uuid.Parse(id); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(traject), &c.Traject); err != nil {
+			return nil, err
+		}
+		crossings = append(crossings, c)
+	}
+
+	return crossings, rows.Err()
+}
+
+// QueryAggregates returns aggregates of interval and camera which started from time from until time to
+// ordered by start. If camera is empty, aggregates of all cameras are returned.
+// It returns error if the database query fails.
+func (j *Journal) QueryAggregates(interval string, from, to time.Time, camera string) ([]*Aggregate, error) {
+	rows, err := j.db.Query(`SELECT camera, interval, start_time, end_time, cars_in, cars_out, peak, mean, occupancy
+		FROM aggregates WHERE interval = ? AND start_time >= ? AND start_time < ? AND (? = '' OR camera = ?)
+		ORDER BY start_time, camera`, interval, toMillis(from), toMillis(to), camera, camera)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aggregates []*Aggregate
+	for rows.Next() {
+		var start, end int64
+		a := new(Aggregate)
+		if err := rows.Scan(&a.Camera, &a.Interval, &start, &end, &a.In, &a.Out, &a.Peak, &a.Mean,
+			&a.Occupancy); err != nil {
+			return nil, err
+		}
+		a.Start = time.Unix(0, start*int64(time.Millisecond))
+		a.End = time.Unix(0, end*int64(time.Millisecond))
+		aggregates = append(aggregates, a)
+	}
+
+	return aggregates, rows.Err()
+}
+
+// Close writes queued events and closes the database
+func (j *Journal) Close() error {
+	if j.queue != nil {
+		close(j.queue)
+		<-j.done
+	}
+
+	return j.db.Close()
+}
+
+// toMillis returns t as number of milliseconds since Unix epoch
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// journalTimeLayouts are accepted layouts of journal query times
+var journalTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// parseJournalTime parses journal query time in local time zone
+func parseJournalTime(s string) (time.Time, error) {
+	for _, layout := range journalTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid time %q: expected RFC3339, YYYY-MM-DD HH:MM[:SS] or YYYY-MM-DD", s)
+}
+
+// journalCommand runs journal subcommand with args which exports crossings recorded in a time range as CSV.
+// It returns error if the arguments are invalid or the journal can't be queried.
+func journalCommand(args []string) error {
+	fs := flag.NewFlagSet(name+" journal", flag.ExitOnError)
+	cfgPath := fs.String("config", "", "Path to JSON configuration file with journal database path")
+	dbPath := fs.String("db", "", "Path to journal database; overrides the path in configuration file")
+	fromFlag := fs.String("from", "", "Export events recorded at or after this time; all events if empty")
+	toFlag := fs.String("to", "", "Export events recorded before this time; defaults to now")
+	camera := fs.String("camera", "", "Export events of this camera only")
+	hourly := fs.Bool("hourly", false, "Export number of cars in and out per hour instead of events")
+	interval := fs.String("aggregates", "", "Export aggregate statistics of this interval e.g. 1h instead of events")
+	out := fs.String("out", "", "Path to CSV file; defaults to standard output")
+	fs.Parse(args)
+
+	path := *dbPath
+	if path == "" {
+		cfg, err := LoadConfig(*cfgPath)
+		if err != nil {
+			return fmt.Errorf("Invalid configuration: %v", err)
+		}
+		path = cfg.Journal.Path
+	}
+	if path == "" {
+		return fmt.Errorf("Journal database path not set: use -db or -config")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	var from time.Time
+	to := time.Now()
+	var err error
+	if *fromFlag != "" {
+		if from, err = parseJournalTime(*fromFlag); err != nil {
+			return err
+		}
+	}
+	if *toFlag != "" {
+		if to, err = parseJournalTime(*toFlag); err != nil {
+			return err
+		}
+	}
+
+	j, err := OpenJournalReadOnly(path)
+	if err != nil {
+		return err
+	}
+	defer j.Close()
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *interval != "" {
+		aggregates, err := j.QueryAggregates(*interval, from, to, *camera)
+		if err != nil {
+			return err
+		}
+		return writeAggregatesCSV(w, aggregates)
+	}
+
+	crossings, err := j.Query(from, to, *camera)
+	if err != nil {
+		return err
+	}
+
+	if *hourly {
+		return writeHourlyCSV(w, crossings)
+	}
+
+	return writeCrossingsCSV(w, crossings)
+}
+
+// writeCrossingsCSV writes crossings to w as CSV
+func writeCrossingsCSV(w io.Writer, crossings []*Crossing) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "camera", "track_id", "direction", "class", "confidence", "trajectory", "gate", "lot",
+		"from", "to", "revert"})
+
+	for _, c := range crossings {
+		traject, err := json.Marshal(c.Traject)
+		if err != nil {
+			return err
+		}
+		cw.Write([]string{
+			c.Time.Format(time.RFC3339Nano),
+			c.Camera,
+			c.TrackID.String(),
+			c.Direction,
+			c.Class,
+			strconv.FormatFloat(c.Confidence, 'f', 3, 64),
+			string(traject),
+			c.Gate,
+			c.Lot,
+			c.From,
+			c.To,
+			strconv.FormatBool(c.Revert),
+		})
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// hourlyCount is number of cars in and out of a camera in an hour
+type hourlyCount struct {
+	// hour is start of the hour
+	hour time.Time
+	// camera is camera name
+	camera string
+	// in is number of cars in
+	in int
+	// out is number of cars out
+	out int
+}
+
+// writeHourlyCSV writes number of cars in and out per hour and camera counted by crossings to w as CSV.
+// Hours start in local time zone; hours without any crossings are omitted.
+// The hour repeated when clocks go back is written as two rows told apart by their UTC offset.
+func writeHourlyCSV(w io.Writer, crossings []*Crossing) error {
+	counts := make(map[string]*hourlyCount)
+	for _, c := range crossings {
+		t := c.Time.In(time.Local)
+		hour := t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second -
+			time.Duration(t.Nanosecond()))
+		key := hour.Format(time.RFC3339) + "/" + c.Camera
+		if _, ok := counts[key]; !ok {
+			counts[key] = &hourlyCount{hour: hour, camera: c.Camera}
+		}
+		switch c.LotDirection() {
+		case DirIn:
+			counts[key].in += c.Cars()
+		case DirOut:
+			counts[key].out += c.Cars()
+		}
+	}
+
+	rows := make([]*hourlyCount, 0, len(counts))
+	for _, hc := range counts {
+		rows = append(rows, hc)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].hour.Equal(rows[j].hour) {
+			return rows[i].hour.Before(rows[j].hour)
+		}
+		return rows[i].camera < rows[j].camera
+	})
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"hour", "camera", "in", "out"})
+	for _, hc := range rows {
+		cw.Write([]string{hc.hour.Format(time.RFC3339), hc.camera, strconv.Itoa(hc.in), strconv.Itoa(hc.out)})
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// writeAggregatesCSV writes aggregates to w as CSV
+func writeAggregatesCSV(w io.Writer, aggregates []*Aggregate) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"start", "end", "camera", "interval", "in", "out", "peak", "mean", "occupancy"})
+
+	for _, a := range aggregates {
+		cw.Write([]string{
+			a.Start.Format(time.RFC3339),
+			a.End.Format(time.RFC3339),
+			a.Camera,
+			a.Interval,
+			strconv.Itoa(a.In),
+			strconv.Itoa(a.Out),
+			strconv.Itoa(a.Peak),
+			strconv.FormatFloat(a.Mean, 'f', 2, 64),
+			strconv.Itoa(a.Occupancy),
+		})
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
@@ -23,11 +23,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"image"
 	"image/color"
 	"math"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -42,8 +45,8 @@ import (
 const (
 	// name is a program name
 	name = "parking-lot-counter"
-	// topic is MQTT topic
-	topic = "parking/counter"
+	// maxTraject is max number of the latest trajectory points kept for each tracked car
+	maxTraject = 1000
 )
 
 var (
@@ -75,6 +78,12 @@ var (
 	delay float64
 	// filter is should we perform extra image erode filtering on video source
 	filter bool
+	// headless is a flag which instructs the program not to display video window
+	headless bool
+	// configPath is path to JSON configuration file
+	configPath string
+	// config is program configuration
+	config *Config
 )
 
 func init() {
@@ -90,9 +99,11 @@ func init() {
 	flag.IntVar(&maxDist, "max-dist", 300, "Max distance in pixels between two centroids to be considered the same")
 	flag.IntVar(&maxGone, "max-gone", 30, "Max number of frames to track the centroid which doesnt change to be considered gone")
 	flag.BoolVar(&publish, "publish", false, "Publish data analytics to a remote server")
-	flag.IntVar(&rate, "rate", 1, "Number of seconds between analytics are sent to a remote server")
+	flag.IntVar(&rate, "rate", 1, "Default number of seconds between periodic analytics are sent to publishing sinks")
 	flag.Float64Var(&delay, "delay", 5.0, "Video playback delay")
 	flag.BoolVar(&filter, "filter", false, "Perform erode filtering on video source before processing")
+	flag.BoolVar(&headless, "headless", false, "Run without displaying video window")
+	flag.StringVar(&configPath, "config", "", "Path to JSON configuration file")
 }
 
 // Perf stores inference engine performance info
@@ -147,6 +158,10 @@ type Centroid struct {
 	ID uuid.UUID
 	// Point is centeer point of the centroid
 	Point image.Point
+	// Rect is bounding box of the car detected at the centroid
+	Rect image.Rectangle
+	// Confidence is detection confidence of the centroid
+	Confidence float64
 	// goneCount is number of frames centroid has been marked as gone
 	goneCount int
 }
@@ -160,12 +175,44 @@ func (c Centroid) String() string {
 type Car struct {
 	// ID is car ID
 	ID uuid.UUID
-	// Traject is car trajectory
+	// Traject is car trajectory; only the latest maxTraject points are kept
 	Traject []image.Point
+	// Times are times of the trajectory points
+	Times []time.Time
+	// detected flags the trajectory points the car was detected at; the others repeat its last known position
+	detected []bool
+	// Rect is bounding box of the car in the last frame it was detected in
+	Rect image.Rectangle
 	// Dir is car direction
 	Dir Direction
+	// Confidence is mean detection confidence of the car
+	Confidence float64
+	// Speed is estimated car speed in km/h; 0 if not estimated
+	Speed float64
+	// detections is number of frames the car was detected in
+	detections int
 	// counted is used to flag car as counted
 	counted bool
+	// countedDir is direction the car was counted in
+	countedDir string
+	// countedAt is time the car was counted
+	countedAt time.Time
+	// maneuver is wrong-way maneuver detected on the car trajectory
+	maneuver string
+	// gates are the last positions of the car registered on sides of counting gates
+	gates map[string]*gatePosition
+	// zone is name of the last counting zone the car was in
+	zone string
+	// nextZone is name of the counting zone the car has been in for nextZoneFrames frames without entering it yet
+	nextZone string
+	// nextZoneFrames is number of consecutive frames the car has been in nextZone
+	nextZoneFrames int
+	// plausible is used to flag car whose track is plausible to be counted
+	plausible bool
+	// peak is peak speed of the car in pixels per second measured over plausible window
+	peak float64
+	// learned is used to flag car whose detection has been learned as a prior
+	learned bool
 	// gone is used to mark the car as gone
 	gone bool
 }
@@ -230,21 +277,36 @@ func (c Car) Direction(p image.Point) Direction {
 	return STILL
 }
 
+// lastDetected returns index of the last trajectory point the car was detected at
+func (c *Car) lastDetected() int {
+	i := len(c.detected) - 1
+	for i > 0 && !c.detected[i] {
+		i--
+	}
+
+	return i
+}
+
 // CarMap is a map of tracked cars
 type CarMap map[uuid.UUID]*Car
 
-// Add adds new car with centroid c to the map of tracked cars.
+// Add adds new car with centroid c seen at time t to the map of tracked cars.
 // It retruns bool to report if the addition was successful
-func (cm CarMap) Add(c *Centroid) bool {
+func (cm CarMap) Add(c *Centroid, t time.Time) bool {
 	traject := make([]image.Point, 0)
 	traject = append(traject, c.Point)
 
 	car := &Car{
-		ID:      c.ID,
-		Traject: traject,
-		Dir:     STILL,
-		counted: false,
-		gone:    false,
+		ID:         c.ID,
+		Traject:    traject,
+		Times:      []time.Time{t},
+		detected:   []bool{true},
+		Rect:       c.Rect,
+		Dir:        STILL,
+		Confidence: c.Confidence,
+		detections: 1,
+		counted:    false,
+		gone:       false,
 	}
 
 	cm[c.ID] = car
@@ -257,9 +319,18 @@ func (cm CarMap) Remove(id uuid.UUID) {
 	delete(cm, id)
 }
 
-// Update updates tracked car map with centroids.
+// RemoveGone removes the cars which are gone
+func (cm CarMap) RemoveGone() {
+	for id := range cm {
+		if cm[id].gone {
+			cm.Remove(id)
+		}
+	}
+}
+
+// Update updates tracked car map with centroids seen at time t.
 // It updates tracking info of the tracked centroids and starts tracking new centroids.
-func (cm CarMap) Update(centroids CentroidMap) {
+func (cm CarMap) Update(centroids CentroidMap, t time.Time) {
 	// mark the cars which disappeared from centroids as gone
 	for id := range cm {
 		if _, present := centroids[id]; !present {
@@ -274,24 +345,173 @@ func (cm CarMap) Update(centroids CentroidMap) {
 	// start tracking new centroids i.e. cars
 	for id := range centroids {
 		if _, tracked := cm[id]; !tracked {
-			cm.Add(centroids[id])
+			cm.Add(centroids[id], t)
 		} else {
+			// drop the oldest trajectory point so that the trajectory doesn't grow without bound;
+			// the points are never modified as they are shared with the state served by the API
+			if len(cm[id].Traject) >= maxTraject {
+				cm[id].Traject = cm[id].Traject[1:]
+				cm[id].Times = cm[id].Times[1:]
+				cm[id].detected = cm[id].detected[1:]
+			}
 			cm[id].Traject = append(cm[id].Traject, centroids[id].Point)
+			cm[id].Times = append(cm[id].Times, t)
+			cm[id].detected = append(cm[id].detected, centroids[id].goneCount == 0)
 			cm[id].Dir = cm[id].Direction(centroids[id].Point)
+			// only the frames the car was detected in contribute to its confidence
+			if centroids[id].goneCount == 0 {
+				cm[id].Rect = centroids[id].Rect
+				cm[id].detections++
+				cm[id].Confidence += (centroids[id].Confidence - cm[id].Confidence) / float64(cm[id].detections)
+			}
 		}
 	}
 }
 
+const (
+	// DirIn is direction of cars entering the parking lot
+	DirIn = "in"
+	// DirOut is direction of cars leaving the parking lot
+	DirOut = "out"
+	// CarClass is object class of detected cars
+	CarClass = "car"
+)
+
+// Crossing is an event of car crossing the parking lot entrance
+type Crossing struct {
+	// Time is time of the crossing
+	Time time.Time `json:"time"`
+	// Camera is name of the camera which observed the crossing
+	Camera string `json:"camera"`
+	// TrackID is ID of the tracked car
+	TrackID uuid.UUID `json:"track_id"`
+	// Direction is crossing direction: in or out
+	Direction string `json:"direction"`
+	// Class is object class of the tracked car
+	Class string `json:"class"`
+	// Confidence is mean detection confidence of the tracked car
+	Confidence float64 `json:"confidence"`
+	// Traject is car trajectory
+	Traject []image.Point `json:"trajectory"`
+	// Gate is name of the gate crossed; empty if the car crossed the entrance
+	Gate string `json:"gate,omitempty"`
+	// Lot is direction the crossing was counted in the parking lot: in, out or empty if it wasn't;
+	// omitted if the car crossed the entrance
+	Lot string `json:"lot,omitempty"`
+	// From is name of the zone the car left; empty if the car didn't move between zones
+	From string `json:"from,omitempty"`
+	// To is name of the zone the car entered; empty if the car didn't move between zones
+	To string `json:"to,omitempty"`
+	// Revert is true if the crossing reverts the earlier count of the car in the direction
+	Revert bool `json:"revert,omitempty"`
+}
+
+// LotDirection returns direction the crossing was counted in the parking lot: in, out or empty if it wasn't
+func (c *Crossing) LotDirection() string {
+	if c.Gate == "" {
+		return c.Direction
+	}
+
+	return c.Lot
+}
+
+// Cars returns number of cars the crossing adds to the count in its direction: -1 if it reverts a count, 1 otherwise
+func (c *Crossing) Cars() int {
+	if c.Revert {
+		return -1
+	}
+
+	return 1
+}
+
+// NewCrossing creates new crossing event of car in direction dir and returns it
+func NewCrossing(car *Car, dir string) *Crossing {
+	traject := make([]image.Point, len(car.Traject))
+	copy(traject, car.Traject)
+
+	return &Crossing{
+		Time:       time.Now(),
+		Camera:     config.Camera,
+		TrackID:    car.ID,
+		Direction:  dir,
+		Class:      CarClass,
+		Confidence: car.Confidence,
+		Traject:    traject,
+	}
+}
+
 // ParkingLot is a parking lot
 type ParkingLot struct {
 	// TotalIn is a counter that counts cars entering the parking lot
 	TotalIn int
 	// TotalOut is a counter that counts cars leaving the parking lot
 	TotalOut int
+	// Baseline is number of cars parked in the parking lot when the counters were last reset
+	Baseline int
+	// ResetAt is time the counters were last reset
+	ResetAt time.Time
+	// Gates are counters of counting gates keyed by gate name
+	Gates map[string]*GateTotals
+	// State is occupancy state
+	State OccupancyState
+}
+
+// Occupancy returns number of cars currently parked in the parking lot
+func (p *ParkingLot) Occupancy() int {
+	return p.Baseline + p.TotalIn - p.TotalOut
+}
+
+// SetOccupancy adjusts the baseline so that the parking lot occupancy is n
+func (p *ParkingLot) SetOccupancy(n int) {
+	p.Baseline = n - p.TotalIn + p.TotalOut
+}
+
+// Reset resets in and out counters keeping the current occupancy as the new baseline
+func (p *ParkingLot) Reset() {
+	p.Baseline = p.Occupancy()
+	p.TotalIn = 0
+	p.TotalOut = 0
+	p.ResetAt = time.Now()
+	for _, g := range p.Gates {
+		*g = GateTotals{}
+	}
+}
+
+// count counts car crossing the entrance in direction dir and returns the crossing event
+func (p *ParkingLot) count(car *Car, dir string) *Crossing {
+	switch dir {
+	case DirIn:
+		p.TotalIn++
+	case DirOut:
+		p.TotalOut++
+	}
+	car.counted = true
+	car.countedDir = dir
+	car.countedAt = time.Now()
+
+	return NewCrossing(car, dir)
+}
+
+// revert reverts the count of car and returns the reversing crossing event.
+// The car stays counted so that it isn't counted again.
+func (p *ParkingLot) revert(car *Car) *Crossing {
+	switch car.countedDir {
+	case DirIn:
+		p.TotalIn--
+	case DirOut:
+		p.TotalOut--
+	}
+	c := NewCrossing(car, car.countedDir)
+	c.Revert = true
+	car.countedDir = ""
+
+	return c
 }
 
 // Update updates parking lot counters using the tracked cars.
-func (p *ParkingLot) Update(cars CarMap) {
+// It returns crossing events of the cars which have been counted.
+func (p *ParkingLot) Update(cars CarMap) []*Crossing {
+	var crossings []*Crossing
 	// iterate through all cars and update global counters
 	for id := range cars {
 		if !cars[id].counted {
@@ -299,45 +519,41 @@ func (p *ParkingLot) Update(cars CarMap) {
 				switch entrance {
 				case "t":
 					if cars[id].Dir == DOWN {
-						p.TotalIn++
-						cars[id].counted = true
+						crossings = append(crossings, p.count(cars[id], DirIn))
 					}
 				case "l":
 					if cars[id].Dir == RIGHT {
-						p.TotalIn++
-						cars[id].counted = true
+						crossings = append(crossings, p.count(cars[id], DirIn))
 					}
 				case "b":
 					if cars[id].Dir == UP {
-						p.TotalIn++
-						cars[id].counted = true
+						crossings = append(crossings, p.count(cars[id], DirIn))
 					}
 				case "r":
 					if cars[id].Dir == LEFT {
-						p.TotalIn++
-						cars[id].counted = true
+						crossings = append(crossings, p.count(cars[id], DirIn))
 					}
 				}
 			} else {
 				switch entrance {
 				case "t":
 					if cars[id].Dir == UP {
-						p.TotalOut++
+						crossings = append(crossings, p.count(cars[id], DirOut))
 						cars.Remove(id)
 					}
 				case "l":
 					if cars[id].Dir == LEFT {
-						p.TotalOut++
+						crossings = append(crossings, p.count(cars[id], DirOut))
 						cars.Remove(id)
 					}
 				case "b":
 					if cars[id].Dir == DOWN {
-						p.TotalOut++
+						crossings = append(crossings, p.count(cars[id], DirOut))
 						cars.Remove(id)
 					}
 				case "r":
 					if cars[id].Dir == RIGHT {
-						p.TotalOut++
+						crossings = append(crossings, p.count(cars[id], DirOut))
 						cars.Remove(id)
 					}
 				}
@@ -348,20 +564,24 @@ func (p *ParkingLot) Update(cars CarMap) {
 			}
 		}
 	}
+
+	return crossings
 }
 
 // CentroidMap is a map of car centroids.
 type CentroidMap map[uuid.UUID]*Centroid
 
-// Add adds new centroid p to centroid map.
+// Add adds new centroid of detection d to centroid map.
 // It retruns bool to signal if the addition was successful or not.
-func (cm CentroidMap) Add(p image.Point) bool {
+func (cm CentroidMap) Add(d *Detection) bool {
 	ID := uuid.New()
 
 	c := &Centroid{
-		ID:        ID,
-		Point:     p,
-		goneCount: 0,
+		ID:         ID,
+		Point:      d.Point,
+		Rect:       d.Rect,
+		Confidence: d.Confidence,
+		goneCount:  0,
 	}
 
 	cm[ID] = c
@@ -374,11 +594,11 @@ func (cm CentroidMap) Remove(id uuid.UUID) {
 	delete(cm, id)
 }
 
-// Update updates centroid map based on centerpoints
-func (cm CentroidMap) Update(points []image.Point) {
+// Update updates centroid map based on center points of detections
+func (cm CentroidMap) Update(detections []*Detection) {
 	// if no points are passed in, increment gone count of all existing centroids and
 	// stop tracking the centroids which exceeded maxGone threshold
-	if len(points) == 0 {
+	if len(detections) == 0 {
 		for id := range cm {
 			cm[id].goneCount++
 			if cm[id].goneCount > maxGone {
@@ -397,22 +617,24 @@ func (cm CentroidMap) Update(points []image.Point) {
 	// If no centroids are tracked yet, start tracking all new points
 	// Otherwise update existing centroids with new points locations
 	if len(cm) == 0 {
-		for i := range points {
-			cm.Add(points[i])
+		for i := range detections {
+			cm.Add(detections[i])
 		}
 	} else {
-		for i := range points {
-			id, dist := cm.ClosestDist(points[i])
+		for i := range detections {
+			id, dist := cm.ClosestDist(detections[i].Point)
 			// if the distance from the point to the closest centroid is too large,
 			// don't associate them together
 			if dist > float64(maxDist) {
 				continue
 			}
 			// update position of the closest centroid and reset its goneCount
-			cm[id].Point = points[i]
+			cm[id].Point = detections[i].Point
+			cm[id].Rect = detections[i].Rect
+			cm[id].Confidence = detections[i].Confidence
 			cm[id].goneCount = 0
 			// keep track of already mapped points and updated centroids
-			mappedPoints[i] = points[i]
+			mappedPoints[i] = detections[i].Point
 			updatedCentroids[id] = cm[id]
 		}
 
@@ -429,9 +651,9 @@ func (cm CentroidMap) Update(points []image.Point) {
 
 		// iterate through center points and start tracking the points that are NOT yet mapped to
 		// any of the already tracked centroids i.e. add them in
-		for i := range points {
+		for i := range detections {
 			if _, ok := mappedPoints[i]; !ok {
-				cm.Add(points[i])
+				cm.Add(detections[i])
 			}
 		}
 	}
@@ -484,16 +706,54 @@ type Result struct {
 	CarsIn int
 	// CarsOut is a counter for cars leaving the parking lot
 	CarsOut int
+	// Occupancy is number of cars parked in the parking lot
+	Occupancy int
+	// Capacity is number of parking spaces; 0 if not configured
+	Capacity int
+	// State is occupancy state
+	State OccupancyState
+	// OccupancyChange is occupancy state change in the processed frame; nil if the state hasn't changed
+	OccupancyChange *OccupancyChange
+	// Crossings are crossing events detected in the processed frame
+	Crossings []*Crossing
+	// Corrections are counter corrections made since the previous result
+	Corrections []*Correction
+	// Aggregates are aggregate statistics of time buckets which ended since the previous result
+	Aggregates []*Aggregate
+	// Dwells are dwell events of the cars which are no longer tracked
+	Dwells []*Dwell
+	// Alerts are alerts raised or cleared in the processed frame
+	Alerts []*Alert
+	// Maneuvers are wrong-way and U-turn maneuvers detected in the processed frame
+	Maneuvers []*Maneuver
+	// Speedings are speeding events detected in the processed frame
+	Speedings []*Speeding
+	// SpaceChanges are parking space state changes detected in the processed frame
+	SpaceChanges []*SpaceChange
+	// SpaceMap is map of parking spaces; nil if no parking space state has changed
+	SpaceMap *SpaceMap
+	// Queue is queue length at the entry barrier; nil if the length hasn't changed
+	Queue *Queue
 }
 
 // String implements fmt.Stringer interface for Result
 func (r *Result) String() string {
-	return fmt.Sprintf("Cars In %d, Cars Out: %d", r.CarsIn, r.CarsOut)
+	if r.Capacity == 0 {
+		return fmt.Sprintf("Occupancy: %d, Cars In %d, Cars Out: %d", r.Occupancy, r.CarsIn, r.CarsOut)
+	}
+
+	return fmt.Sprintf("Occupancy: %d/%d %s, Cars In %d, Cars Out: %d", r.Occupancy, r.Capacity, r.State,
+		r.CarsIn, r.CarsOut)
 }
 
 // ToMQTTMessage turns result into MQTT message which can be published to MQTT broker
 func (r *Result) ToMQTTMessage() string {
-	return fmt.Sprintf("{\"TOTAL_IN\":%d, \"TOTAL_OUT\": %d}", r.CarsIn, r.CarsOut)
+	if r.Capacity == 0 {
+		return fmt.Sprintf("{\"TOTAL_IN\":%d, \"TOTAL_OUT\": %d, \"OCCUPANCY\": %d}", r.CarsIn, r.CarsOut, r.Occupancy)
+	}
+
+	return fmt.Sprintf("{\"TOTAL_IN\":%d, \"TOTAL_OUT\": %d, \"OCCUPANCY\": %d, \"CAPACITY\": %d, \"STATE\": \"%s\"}",
+		r.CarsIn, r.CarsOut, r.Occupancy, r.Capacity, r.State)
 }
 
 // getPerformanceInfo queries the Inference Engine performance info and returns it
@@ -507,23 +767,58 @@ func getPerformanceInfo(net *gocv.Net) *Perf {
 	}
 }
 
-// messageRunner reads data published to pubChan with rate frequency and sends them to remote analytics server
+// messageRunner reads data published to pubChan and sends them to publisher p
+// Publisher sinks filter and rate limit the messages according to their configuration.
 // doneChan is used to receive a signal from the main goroutine to notify the routine to stop and return
-func messageRunner(doneChan <-chan struct{}, pubChan <-chan *Result, c *MQTTClient, topic string, rate int) error {
-	ticker := time.NewTicker(time.Duration(rate) * time.Second)
+func messageRunner(doneChan <-chan struct{}, pubChan <-chan *Result, p Publisher) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	for {
 		select {
-		case <-ticker.C:
-			result := <-pubChan
-			_, err := c.Publish(topic, result.ToMQTTMessage())
+		case result := <-pubChan:
+			if result == nil {
+				continue
+			}
+			for _, c := range result.Corrections {
+				publishEvent(ctx, p, CorrectionMessage, c.Time, c)
+			}
+			for _, a := range result.Aggregates {
+				publishEvent(ctx, p, AggregateMessage, a.End, a)
+			}
+			if result.OccupancyChange != nil {
+				publishEvent(ctx, p, OccupancyMessage, result.OccupancyChange.Time, result.OccupancyChange)
+			}
+			for _, c := range result.Crossings {
+				publishEvent(ctx, p, CrossingMessage, c.Time, c)
+			}
+			for _, m := range result.Maneuvers {
+				publishEvent(ctx, p, ManeuverMessage, m.Time, m)
+			}
+			for _, e := range result.Speedings {
+				publishEvent(ctx, p, SpeedingMessage, e.Time, e)
+			}
+			for _, c := range result.SpaceChanges {
+				publishEvent(ctx, p, SpaceMessage, c.Time, c)
+			}
+			if result.SpaceMap != nil {
+				publishEvent(ctx, p, SpacesMessage, result.SpaceMap.Time, result.SpaceMap)
+			}
+			if result.Queue != nil {
+				publishEvent(ctx, p, QueueMessage, result.Queue.Time, result.Queue)
+			}
+			for _, d := range result.Dwells {
+				publishEvent(ctx, p, DwellMessage, d.Time, d)
+			}
+			for _, a := range result.Alerts {
+				publishEvent(ctx, p, AlertMessage, a.Time, a)
+			}
+			err := p.Publish(ctx, NewMessage(TotalsMessage, []byte(result.ToMQTTMessage())))
 			// TODO: decide whether to return with error and stop program;
 			// For now we just signal there was an error and carry on
 			if err != nil {
-				fmt.Printf("Error publishing message to %s: %v", topic, err)
+				fmt.Printf("Error publishing message: %v\n", err)
 			}
-		case <-pubChan:
-			// we discard messages in between ticker times
 		case <-doneChan:
 			fmt.Printf("Stopping messageRunner: received stop signal\n")
 			return nil
@@ -531,8 +826,35 @@ func messageRunner(doneChan <-chan struct{}, pubChan <-chan *Result, c *MQTTClie
 	}
 }
 
-// detectCars detects cars in img and returns them as a slice of rectangles that encapsulates them
-func detectCars(net *gocv.Net, img *gocv.Mat) []image.Rectangle {
+// publishEvent publishes event v of type t which happened at time ts to publisher p
+func publishEvent(ctx context.Context, p Publisher, t MessageType, ts time.Time, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("Error encoding %s event: %v\n", t, err)
+		return
+	}
+
+	m := NewMessage(t, data)
+	m.Time = ts
+	if err := p.Publish(ctx, m); err != nil {
+		fmt.Printf("Error publishing message: %v\n", err)
+	}
+}
+
+// Detection is a car detected in a frame
+type Detection struct {
+	// Rect is rectangle encapsulating the car
+	Rect image.Rectangle
+	// Point is center point of the car
+	Point image.Point
+	// Confidence is detection confidence
+	Confidence float64
+	// Label is class label output by the detection model
+	Label int
+}
+
+// detectCars detects cars in img and returns them as a slice of detections with rectangles that encapsulates them
+func detectCars(net *gocv.Net, img *gocv.Mat) []*Detection {
 	// convert img Mat to 672x384 blob that the face detector can analyze
 	blob := gocv.BlobFromImage(*img, 1.0, image.Pt(672, 384), gocv.NewScalar(0, 0, 0, 0), false, false)
 	defer blob.Close()
@@ -543,7 +865,7 @@ func detectCars(net *gocv.Net, img *gocv.Mat) []image.Rectangle {
 	defer results.Close()
 
 	// iterate through all detections and append results to cars buffer
-	var cars []image.Rectangle
+	var cars []*Detection
 	for i := 0; i < results.Total(); i += 7 {
 		confidence := results.GetFloatAt(0, i+2)
 		if float64(confidence) > modelConfidence {
@@ -551,16 +873,21 @@ func detectCars(net *gocv.Net, img *gocv.Mat) []image.Rectangle {
 			top := int(results.GetFloatAt(0, i+4) * float32(img.Rows()))
 			right := int(results.GetFloatAt(0, i+5) * float32(img.Cols()))
 			bottom := int(results.GetFloatAt(0, i+6) * float32(img.Rows()))
-			cars = append(cars, image.Rect(left, top, right, bottom))
+			cars = append(cars, &Detection{
+				Rect:       image.Rect(left, top, right, bottom),
+				Confidence: float64(confidence),
+				Label:      int(results.GetFloatAt(0, i+1)),
+			})
 		}
 	}
 
 	return cars
 }
 
-// extractCenterPoints extracts centroid candidate center points from detected cars and returns them
-func extractCenterPoints(rects []image.Rectangle, img *gocv.Mat) []image.Point {
-	var centerPoints []image.Point
+// extractCenterPoints extracts centroid candidate center points from detected cars.
+// It returns the detections which are valid cars with their center points set.
+func extractCenterPoints(detections []*Detection, img *gocv.Mat) []*Detection {
+	var cars []*Detection
 	// detected car size in pixels
 	var width, height int
 	// center point coordinates
@@ -569,14 +896,16 @@ func extractCenterPoints(rects []image.Rectangle, img *gocv.Mat) []image.Point {
 	wClip, hClip := 200, 350
 
 	// make sure the car rect is completely inside the image frame
-	for i := range rects {
-		if !rects[i].In(image.Rect(0, 0, img.Cols(), img.Rows())) {
+	for i := range detections {
+		// copy the rectangle so the detection keeps the original one
+		rect := detections[i].Rect
+		if !rect.In(image.Rect(0, 0, img.Cols(), img.Rows())) {
 			continue
 		}
 
 		// detected car rectangle dimensions
-		width = rects[i].Size().X
-		height = rects[i].Size().Y
+		width = rect.Size().X
+		height = rect.Size().Y
 
 		// if detected car rectangle is too small, skip it
 		if width < 80 || height < 50 {
@@ -587,58 +916,89 @@ func extractCenterPoints(rects []image.Rectangle, img *gocv.Mat) []image.Point {
 		// so we clip the sizes of the rectangle to avoid skewing the centroid positions
 		// If the clipped size stretches over image frame we clip them with frame size.
 		if width > wClip {
-			if (rects[i].Min.X + wClip) < img.Cols() {
+			if (rect.Min.X + wClip) < img.Cols() {
 				width = wClip
 				// we shift the top left point by 1/4 width clip i.e. left
-				if (rects[i].Min.X - width/4) > 0 {
-					rects[i].Min.X = rects[i].Min.X - width/4
+				if (rect.Min.X - width/4) > 0 {
+					rect.Min.X = rect.Min.X - width/4
 				}
 			}
-		} else if (rects[i].Min.X + width) > img.Cols() {
-			width = img.Cols() - rects[i].Min.X
+		} else if (rect.Min.X + width) > img.Cols() {
+			width = img.Cols() - rect.Min.X
 		}
 
 		if height > hClip {
-			if (rects[i].Min.Y + hClip) < img.Rows() {
+			if (rect.Min.Y + hClip) < img.Rows() {
 				height = hClip
 				// we shift the bottom right point by 1/4 height clip i.e. up
-				if (rects[i].Min.Y - hClip/4) > 0 {
-					rects[i].Min.Y = rects[i].Min.Y - hClip/4
+				if (rect.Min.Y - hClip/4) > 0 {
+					rect.Min.Y = rect.Min.Y - hClip/4
 				}
 			}
-		} else if (rects[i].Min.Y + height) > img.Rows() {
-			height = img.Rows() - rects[i].Min.Y
+		} else if (rect.Min.Y + height) > img.Rows() {
+			height = img.Rows() - rect.Min.Y
 		}
 
 		// center point coordinates
-		X = rects[i].Min.X + width/2
-		Y = rects[i].Min.Y + height/2
+		X = rect.Min.X + width/2
+		Y = rect.Min.Y + height/2
 
-		centerPoints = append(centerPoints, image.Point{X: X, Y: Y})
+		detections[i].Point = image.Point{X: X, Y: Y}
+		cars = append(cars, detections[i])
 	}
 
-	return centerPoints
+	return cars
 }
 
 // frameRunner reads image frames from framesChan and performs face and sentiment detections on them
+// Counted cars update parkingLot counters and their crossings are written to journal unless it's nil.
+// Commands received on ctrlChan are applied to parking lot counters and the counter state is stored in state.
+// Counter corrections are recorded in audit unless it's nil and published along with the next result.
+// Every counter change is observed by aggregator; aggregates of ended buckets are written to journal and published.
+// Tracked cars are passed to dwell monitor which measures their dwell time and raises gate blocking and
+// no parking alerts with snapshots of the cars and to speed monitor which estimates their speed.
+// Detected cars are passed to parking space monitor. Tracked cars queuing at the entry barrier are
+// measured by queue monitor which raises long queue alerts.
+// Cars lost by tracking are re-identified by reid when they reappear. Only the detections and tracks
+// which are plausible cars according to plausibility are tracked and counted.
 // doneChan is used to receive a signal from the main goroutine to notify frameRunner to stop and return
 func frameRunner(framesChan <-chan *frame, doneChan <-chan struct{}, resultsChan chan<- *Result,
-	pubChan chan<- *Result, carNet *gocv.Net) error {
+	pubChan chan<- *Result, ctrlChan <-chan *Command, state *State, parkingLot *ParkingLot, journal *Journal,
+	audit *Audit, aggregator *Aggregator, dwell *DwellMonitor, speed *SpeedMonitor, spaces *SpaceMonitor,
+	queue *QueueMonitor, reid *ReID, plausibility *Plausibility, carNet *gocv.Net) error {
 
 	// frame is image frame
 	frame := new(frame)
-	// result stores results to be sent down to main goroutine
-	result := new(Result)
 	// perf is inference engine performance
 	perf := new(Perf)
 	// centroid keeps the list of all tracked centroids
 	centroids := make(CentroidMap)
 	// cars keeps the list of all tracked cars
 	cars := make(CarMap)
-	// parkingLot is the parking lot we are monitoring
-	parkingLot := new(ParkingLot)
 	// kernel to use for erode filtering, if enabled
 	kernel := gocv.GetStructuringElement(gocv.MorphRect, image.Pt(12, 12))
+	// corrections are counter corrections which haven't been published yet
+	var corrections []*Correction
+	// aggregates are aggregates of ended buckets which haven't been published yet
+	var aggregates []*Aggregate
+	// observe passes counter change at time t to aggregator
+	observe := func(t time.Time, crossings []*Crossing) {
+		ended := aggregator.Observe(t, parkingLot.Occupancy(), crossings)
+		if journal != nil {
+			journal.RecordAggregates(ended)
+		}
+		aggregates = append(aggregates, ended...)
+	}
+	// correct records counter correction c
+	correct := func(c *Correction) {
+		fmt.Printf("Occupancy corrected by %d: %s by %s\n", c.Delta, c.Action, c.Source)
+		if audit != nil {
+			if err := audit.Record(c); err != nil {
+				fmt.Printf("Error recording correction: %v\n", err)
+			}
+		}
+		corrections = append(corrections, c)
+	}
 
 	for {
 		select {
@@ -651,6 +1011,17 @@ func frameRunner(framesChan <-chan *frame, doneChan <-chan struct{}, resultsChan
 				close(pubChan)
 			}
 			return nil
+		case cmd := <-ctrlChan:
+			before := parkingLot.Counts()
+			err := cmd.Apply(parkingLot)
+			if err == nil {
+				parkingLot.Clamp(config.Occupancy.Capacity)
+				correct(NewCorrection(cmd.Name, cmd.Source, cmd.Reason, before, parkingLot))
+				observe(time.Now(), nil)
+				state.UpdateTotals(parkingLot)
+				recordOccupancy(config.Camera, parkingLot.Occupancy())
+			}
+			cmd.done <- err
 		case frame = <-framesChan:
 			if frame == nil {
 				continue
@@ -664,27 +1035,98 @@ func frameRunner(framesChan <-chan *frame, doneChan <-chan struct{}, resultsChan
 				gocv.Erode(img, &img, kernel)
 			}
 
-			// detect cars in the current frame
-			carRects := detectCars(carNet, &img)
+			// detect cars in the current frame and suppress the detections which are not plausible cars
+			detections := plausibility.Detections(detectCars(carNet, &img))
+
+			// update parking space states with all detected cars
+			spaceChanges, spaceMap := spaces.Update(frame.captured, detections)
+			if spaceMap != nil {
+				state.UpdateSpaces(spaceMap)
+			}
 
 			// extract car center points: not all car detections are valid cars
-			centerPoints := extractCenterPoints(carRects, &img)
+			carDetections := extractCenterPoints(detections, &img)
 
 			// update tracked centroids with the points detected in the frame
-			centroids.Update(centerPoints)
+			centroids.Update(carDetections)
+
+			// re-identify lost cars which reappeared in new centroids
+			reid.Update(frame.captured, &img, carDetections, centroids, cars)
 
 			// update tracked cars based on centroids
-			cars.Update(centroids)
+			cars.Update(centroids, frame.captured)
+
+			// only count the cars whose tracks are plausible
+			tracks := plausibility.Tracks(cars, carDetections)
 
-			// update parking lot counters
-			parkingLot.Update(cars)
+			// detect wrong-way and U-turn maneuvers and count the cars which made them
+			maneuvers, crossings, reverted := parkingLot.Maneuvers(tracks, config.WrongWay)
+			for _, c := range reverted {
+				correct(c)
+			}
+
+			// update parking lot counters at the gates, zones or the entrance
+			switch {
+			case len(config.Gates.Gates) > 0:
+				crossings = append(crossings, parkingLot.UpdateGates(tracks, config.Gates)...)
+			case len(config.Zones.Zones) > 0:
+				crossings = append(crossings, parkingLot.UpdateZones(tracks, config.Zones)...)
+			default:
+				crossings = append(crossings, parkingLot.Update(tracks)...)
+			}
+			cars.RemoveGone()
+			tracks.RemoveGone()
+			before := parkingLot.Counts()
+			if n := parkingLot.Clamp(config.Occupancy.Capacity); n != 0 {
+				correct(NewCorrection(ClampCorrection, "auto", "occupancy out of capacity range", before, parkingLot))
+			}
+			occupancyChange := parkingLot.UpdateState(config.Occupancy)
+			observe(frame.captured, crossings)
+			// track analytics only consider plausible tracks, so that e.g. pedestrians don't raise alerts
+			dwells, alerts := dwell.Update(frame.captured, tracks)
+			for _, a := range alerts {
+				if a.Type == NoParkingAlert && a.Active {
+					a.Snapshot = snapshot(&img, a.rect)
+				}
+			}
+			speedings := speed.Update(frame.captured, tracks, image.Pt(img.Cols(), img.Rows()))
+			queueLen, queueAlerts := queue.Update(frame.captured, tracks)
+			alerts = append(alerts, queueAlerts...)
+			if queueLen != nil {
+				recordQueue(config.Camera, queueLen)
+			}
+			if journal != nil {
+				journal.Record(crossings)
+			}
 
 			perf = getPerformanceInfo(carNet)
 			// detection result
-			result.Perf = perf
-			result.Centroids = centroids
-			result.CarsIn = parkingLot.TotalIn
-			result.CarsOut = parkingLot.TotalOut
+			result := &Result{
+				Perf:            perf,
+				Centroids:       centroids,
+				CarsIn:          parkingLot.TotalIn,
+				CarsOut:         parkingLot.TotalOut,
+				Occupancy:       parkingLot.Occupancy(),
+				Capacity:        config.Occupancy.Capacity,
+				State:           parkingLot.State,
+				Crossings:       crossings,
+				OccupancyChange: occupancyChange,
+				Corrections:     corrections,
+				Aggregates:      aggregates,
+				Dwells:          dwells,
+				Alerts:          alerts,
+				Maneuvers:       maneuvers,
+				Speedings:       speedings,
+				SpaceChanges:    spaceChanges,
+				SpaceMap:        spaceMap,
+				Queue:           queueLen,
+			}
+			corrections = nil
+			aggregates = nil
+
+			// update counter state served by the API and metrics
+			state.Update(parkingLot, centroids, cars, perf)
+			recordFrame(config.Camera, result, len(cars), frame.captured)
 
 			// send data down the channels
 			resultsChan <- result
@@ -698,6 +1140,13 @@ func frameRunner(framesChan <-chan *frame, doneChan <-chan struct{}, resultsChan
 	}
 }
 
+// drawPolygon draws outline of polygon pg in color c on img
+func drawPolygon(img *gocv.Mat, pg Polygon, c color.RGBA) {
+	for i := range pg {
+		gocv.Line(img, pg[i], pg[(i+1)%len(pg)], c, 2)
+	}
+}
+
 func parseCliFlags() error {
 	// parse cli flags
 	flag.Parse()
@@ -711,6 +1160,13 @@ func parseCliFlags() error {
 		return fmt.Errorf("Invalid path to .xml file of face model modelConfiguration: %s", modelConfig)
 	}
 
+	// read program configuration
+	var err error
+	config, err = LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
+
 	return nil
 }
 
@@ -758,9 +1214,9 @@ func NewCapture(input string, deviceID int, delay *float64) (*gocv.VideoCapture,
 }
 
 // NewMQTTPublisher creates new MQTT client which collects analytics data and publishes them to remote MQTT server.
-// It attempts to make a connection to the remote server and if successful it return the client handler
+// It attempts to make a connection to the remote server until ctx is cancelled and if successful it return the publisher
 // It returns error if either the connection to the remote server failed or if the client modelConfig is invalid.
-func NewMQTTPublisher() (*MQTTClient, error) {
+func NewMQTTPublisher(ctx context.Context, cfg *Config) (*MQTTPublisher, error) {
 	// create MQTT client and connect to MQTT server
 	opts, err := MQTTClientOptions()
 	if err != nil {
@@ -768,21 +1224,47 @@ func NewMQTTPublisher() (*MQTTClient, error) {
 	}
 
 	// create MQTT client ad connect to remote server
-	c, err := MQTTConnect(opts)
+	c, err := MQTTConnect(ctx, opts, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return c, nil
+	// subscribe to command topic if configured
+	if err := c.SubscribeCommands(); err != nil {
+		c.Disconnect(100)
+		return nil, err
+	}
+
+	return &MQTTPublisher{client: c}, nil
+}
+
+// source returns description of video source used in status reports
+func source(input string, deviceID int) string {
+	if input != "" {
+		return input
+	}
+
+	return fmt.Sprintf("device %d", deviceID)
 }
 
 // frame is used to send video frames to upstream goroutines
 type frame struct {
 	// img is image frame
 	img *gocv.Mat
+	// captured is time the frame was read from video source
+	captured time.Time
 }
 
 func main() {
+	// run journal subcommand
+	if len(os.Args) > 1 && os.Args[1] == "journal" {
+		if err := journalCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error exporting journal: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// parse cli flags
 	if err := parseCliFlags(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error parsing command line parameters: %v\n", err)
@@ -807,7 +1289,7 @@ func main() {
 	// frames channel provides the source of images to process
 	framesChan := make(chan *frame, 1)
 	// errChan is a channel used to capture program errors
-	errChan := make(chan error, 2)
+	errChan := make(chan error, 5)
 	// doneChan is used to signal goroutines they need to stop
 	doneChan := make(chan struct{})
 	// resultsChan is used for detection distribution
@@ -815,38 +1297,164 @@ func main() {
 	// sigChan is used as a handler to stop all the goroutines
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, os.Kill, syscall.SIGTERM)
+	// restore parking lot counters saved before the program was stopped
+	parkingLot, err := LoadParkingLot(config.Persist.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error restoring parking lot state: %v\n", err)
+		os.Exit(1)
+	}
+
+	// journal keeps crossing events in local database
+	var journal *Journal
+	if config.Journal.Path != "" {
+		journal, err = OpenJournal(config.Journal.Path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening event journal: %v\n", err)
+			os.Exit(1)
+		}
+		defer journal.Close()
+	}
+
+	// audit keeps audit trail of counter corrections
+	var audit *Audit
+	if config.Audit.Path != "" {
+		audit, err = OpenAudit(config.Audit.Path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening audit trail: %v\n", err)
+			os.Exit(1)
+		}
+		defer audit.Close()
+	}
+
+	// aggregator computes aggregate statistics of time buckets
+	aggregator := NewAggregator(config.Camera, config.Aggregates, config.Location())
+
+	// speed estimates speed of tracked cars
+	speed, err := NewSpeedMonitor(config.Speed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading speed calibration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// spaces detects occupancy of parking spaces
+	spaces := NewSpaceMonitor(config.Spaces)
+
+	// reid re-identifies cars lost by tracking
+	reid, err := NewReID(config.ReID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating re-identification model: %v\n", err)
+		os.Exit(1)
+	}
+	defer reid.Close()
+
+	// plausibility suppresses pedestrians and other objects which are not cars
+	plausibility, err := NewPlausibility(config.Plausibility)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading plausibility priors: %v\n", err)
+		os.Exit(1)
+	}
+
+	// ctrlChan is used to send commands to frameRunner
+	ctrlChan := make(chan *Command)
+	// state keeps counter state served by the API
+	state := NewState(config.Camera, source(input, deviceID))
+	state.UpdateTotals(parkingLot)
+	state.UpdateSpaces(spaces.Map(time.Now()))
+	recordOccupancy(config.Camera, parkingLot.Occupancy())
 	// pubChan is used for publishing data analytics stats
 	var pubChan chan *Result
+	// fanOut publishes analytics to publishing sinks
+	var fanOut *FanOut
+	// preview streams annotated video over HTTP
+	var preview *Preview
+	// recorder records annotated video
+	var recorder *Recorder
 	// waitgroup to synchronise all goroutines
 	var wg sync.WaitGroup
 
 	if publish {
-		p, err := NewMQTTPublisher()
+		// connecting to the sinks is abandoned when the program is interrupted
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		p, err := NewFanOut(ctx, config, rate)
+		stop()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create MQTT publisher: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Failed to create publisher: %v\n", err)
 			os.Exit(1)
 		}
+		fanOut = p
 		pubChan = make(chan *Result, 1)
-		// start MQTT worker goroutine
+		// start publisher worker goroutine
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			errChan <- messageRunner(doneChan, pubChan, p, topic, rate)
+			errChan <- messageRunner(doneChan, pubChan, p)
 		}()
-		defer p.Disconnect(100)
+		defer p.Close()
 	}
 
 	// start frameRunner goroutine
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		errChan <- frameRunner(framesChan, doneChan, resultsChan, pubChan, carNet)
+		errChan <- frameRunner(framesChan, doneChan, resultsChan, pubChan, ctrlChan, state, parkingLot, journal, audit,
+			aggregator, NewDwellMonitor(config.Dwell, config.ReID.MaxAge), speed, spaces, NewQueueMonitor(config.Queue), reid, plausibility, carNet)
 	}()
 
-	// open display window
-	window := gocv.NewWindow(name)
-	window.SetWindowProperty(gocv.WindowPropertyAutosize, gocv.WindowAutosize)
-	defer window.Close()
+	// start scheduled commands if configured
+	if len(config.Schedules) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errChan <- scheduleRunner(doneChan, ctrlChan, config.Schedules)
+		}()
+	}
+
+	// start saving parking lot state if configured
+	if config.Persist.Path != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errChan <- persistRunner(doneChan, state, config.Persist)
+		}()
+	}
+
+	// start API server if configured
+	if config.HTTP.Addr != "" {
+		api := NewAPI(config, state, ctrlChan, fanOut)
+		api.Handle("/metrics", MetricsHandler())
+		api.HandleCalibration(speed)
+		preview = NewPreview(config.Preview)
+		api.Handle("/preview/stream.mjpg", http.HandlerFunc(preview.Stream))
+		api.Handle("/preview/snapshot.jpg", http.HandlerFunc(preview.Snapshot))
+		srv := &http.Server{
+			Addr:    config.HTTP.Addr,
+			Handler: api,
+		}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				errChan <- fmt.Errorf("API server failed: %v", err)
+			}
+		}()
+		defer srv.Close()
+	}
+
+	// start video recorder if configured
+	if config.Recorder.Dir != "" {
+		recorder, err = NewRecorder(config.Recorder)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating video recorder: %v\n", err)
+			os.Exit(1)
+		}
+		defer recorder.Close()
+	}
+
+	// open display window unless running headless
+	var window *gocv.Window
+	if !headless {
+		window = gocv.NewWindow(name)
+		window.SetWindowProperty(gocv.WindowPropertyAutosize, gocv.WindowAutosize)
+		defer window.Close()
+	}
 
 	// prepare input image matrix
 	img := gocv.NewMat()
@@ -854,6 +1462,8 @@ func main() {
 
 	// initialize the result pointers
 	result := new(Result)
+	// crossings are crossings detected in the latest result which haven't been recorded yet
+	var crossings []*Crossing
 
 monitor:
 	for {
@@ -862,10 +1472,23 @@ monitor:
 			break
 		}
 		if img.Empty() {
+			state.DropFrame()
+			recordDropped(config.Camera)
 			continue
 		}
 
-		framesChan <- &frame{img: &img}
+		f := &frame{img: &img, captured: time.Now()}
+		if input == "" {
+			// live camera keeps on producing frames so drop the frame if the previous one is still queued
+			select {
+			case framesChan <- f:
+			default:
+				state.DropFrame()
+				recordDropped(config.Camera)
+			}
+		} else {
+			framesChan <- f
+		}
 
 		select {
 		case sig := <-sigChan:
@@ -875,16 +1498,53 @@ monitor:
 			fmt.Printf("Shutting down. Encountered error: %s\n", err)
 			break monitor
 		case result = <-resultsChan:
-			// do nothing here
+			crossings = result.Crossings
 		default:
 			// do nothing; just display latest results
 		}
+		// occupancy label colored by occupancy state
+		gocv.PutText(&img, fmt.Sprintf("%s", result), image.Point{0, 25},
+			gocv.FontHersheySimplex, 0.5, result.State.Color(), 2)
 		// inference performance and print it
-		gocv.PutText(&img, fmt.Sprintf("%s", result.Perf), image.Point{0, 25},
-			gocv.FontHersheySimplex, 0.5, color.RGBA{255, 255, 255, 0}, 2)
-		// inference results label
-		gocv.PutText(&img, fmt.Sprintf("%s", result), image.Point{0, 45},
+		gocv.PutText(&img, fmt.Sprintf("%s", result.Perf), image.Point{0, 45},
 			gocv.FontHersheySimplex, 0.5, color.RGBA{255, 255, 255, 0}, 2)
+		// Draw parking spaces colored by their state
+		if sm := state.Spaces(); sm != nil {
+			for i, sc := range config.Spaces.Spaces {
+				c := color.RGBA{128, 128, 128, 0}
+				switch {
+				case !sm.Spaces[i].Known:
+				case sm.Spaces[i].Occupied:
+					c = color.RGBA{255, 0, 0, 0}
+				default:
+					c = color.RGBA{0, 255, 0, 0}
+				}
+				drawPolygon(&img, sc.Polygon, c)
+			}
+		}
+		// Draw queue zone
+		if len(config.Queue.Zone) > 0 {
+			drawPolygon(&img, config.Queue.Zone, color.RGBA{255, 255, 0, 0})
+		}
+		// Draw no parking zones and label them with names
+		for _, z := range config.Dwell.NoParking {
+			drawPolygon(&img, z.Polygon, color.RGBA{255, 128, 0, 0})
+			gocv.PutText(&img, z.Name, z.Polygon[0].Add(image.Pt(5, 15)), gocv.FontHersheySimplex, 0.5,
+				color.RGBA{255, 128, 0, 0}, 2)
+		}
+		// Draw counting zones and label them with names
+		for _, z := range config.Zones.Zones {
+			drawPolygon(&img, z.Polygon, color.RGBA{0, 255, 255, 0})
+			gocv.PutText(&img, z.Name, z.Polygon[0].Add(image.Pt(5, 15)), gocv.FontHersheySimplex, 0.5,
+				color.RGBA{0, 255, 255, 0}, 2)
+		}
+		// Draw counting gates and label them with names
+		for _, g := range config.Gates.Gates {
+			a, b := image.Pt(g.Line[0][0], g.Line[0][1]), image.Pt(g.Line[1][0], g.Line[1][1])
+			gocv.Line(&img, a, b, color.RGBA{255, 255, 0, 0}, 2)
+			gocv.PutText(&img, g.Name, a.Add(image.Pt(5, -5)), gocv.FontHersheySimplex, 0.5,
+				color.RGBA{255, 255, 0, 0}, 2)
+		}
 		// Draw car centroids and label them with coordinates
 		for id := range result.Centroids {
 			gocv.Circle(&img, result.Centroids[id].Point, 5, color.RGBA{0, 255, 0, 0}, 2)
@@ -892,6 +1552,22 @@ monitor:
 				image.Point{X: result.Centroids[id].Point.X + 5, Y: result.Centroids[id].Point.Y},
 				gocv.FontHersheySimplex, 0.5, color.RGBA{0, 255, 0, 0}, 2)
 		}
+		// stream the annotated image to preview clients
+		if preview != nil {
+			preview.Update(img)
+		}
+		// record the annotated image
+		if recorder != nil {
+			recorder.Write(img, crossings)
+			crossings = nil
+		}
+
+		if window == nil {
+			// keep video playback at its original pace
+			time.Sleep(time.Duration(delay) * time.Millisecond)
+			continue
+		}
+
 		// show the image in the window, and wait 1 millisecond
 		window.IMShow(img)
 
@@ -908,4 +1584,11 @@ monitor:
 	}
 	// wait for all goroutines to finish
 	wg.Wait()
+
+	// save the final parking lot state
+	if config.Persist.Path != "" {
+		if err := SaveTotals(config.Persist.Path, state.Totals()); err != nil {
+			fmt.Printf("Error saving parking lot state: %v\n", err)
+		}
+	}
 }
@@ -0,0 +1,184 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// namespace is namespace of exported Prometheus metrics
+	namespace = "parking"
+)
+
+var (
+	// carsIn counts cars entering the parking lot
+	carsIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cars_in_total",
+		Help:      "Number of cars which entered the parking lot.",
+	}, []string{"camera", "class"})
+	// carsOut counts cars leaving the parking lot
+	carsOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cars_out_total",
+		Help:      "Number of cars which left the parking lot.",
+	}, []string{"camera", "class"})
+	// carsReverted counts reverted counts of cars entering or leaving the parking lot
+	carsReverted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cars_reverted_total",
+		Help:      "Number of cars whose count in or out of the parking lot was reverted.",
+	}, []string{"camera", "class", "direction"})
+	// occupancy is number of cars parked in the parking lot
+	occupancy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "occupancy",
+		Help:      "Number of cars parked in the parking lot.",
+	}, []string{"camera"})
+	// inferenceLatency is car detection inference time
+	inferenceLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "inference_latency_seconds",
+		Help:      "Car detection inference time.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 10),
+	}, []string{"camera"})
+	// frameLatency is time from reading a frame to having its counters updated
+	frameLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "frame_latency_seconds",
+		Help:      "Time from reading a video frame to updating the counters with its detections.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
+	}, []string{"camera"})
+	// activeTracks is number of tracked cars
+	activeTracks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_tracks",
+		Help:      "Number of currently tracked cars.",
+	}, []string{"camera"})
+	// framesDropped is number of video frames which were read but not processed
+	framesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "frames_dropped_total",
+		Help:      "Number of video frames which were read from the video source but not processed.",
+	}, []string{"camera"})
+	// queueLength is number of cars queuing at the entry barrier
+	queueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_length",
+		Help:      "Number of cars queuing at the entry barrier.",
+	}, []string{"camera"})
+	// queueWait is estimated wait of a car joining the queue at the entry barrier
+	queueWait = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Estimated wait of a car joining the queue at the entry barrier.",
+	}, []string{"camera"})
+	// reidentifications counts lost cars re-identified in new tracks
+	reidentifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reidentifications_total",
+		Help:      "Number of cars lost by tracking which were re-identified in new tracks.",
+	}, []string{"camera"})
+	// mqttPublished counts messages published to MQTT server
+	mqttPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_publish_total",
+		Help:      "Number of messages published to MQTT server by result.",
+	}, []string{"camera", "type", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(carsIn, carsOut, carsReverted, occupancy, inferenceLatency, frameLatency,
+		activeTracks, framesDropped, queueLength, queueWait, reidentifications, mqttPublished)
+}
+
+// MetricsHandler returns HTTP handler which serves metrics in Prometheus exposition format
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// recordFrame records metrics of frame processing result r of camera.
+// tracks is number of tracked cars and captured is time the frame was read from the video source.
+func recordFrame(camera string, r *Result, tracks int, captured time.Time) {
+	for _, c := range r.Crossings {
+		// counters can't be decremented so reverted counts are counted separately
+		if c.Revert {
+			carsReverted.WithLabelValues(camera, c.Class, c.LotDirection()).Inc()
+			continue
+		}
+		switch c.LotDirection() {
+		case DirIn:
+			carsIn.WithLabelValues(camera, c.Class).Inc()
+		case DirOut:
+			carsOut.WithLabelValues(camera, c.Class).Inc()
+		}
+	}
+
+	occupancy.WithLabelValues(camera).Set(float64(r.Occupancy))
+	activeTracks.WithLabelValues(camera).Set(float64(tracks))
+	if r.Perf != nil {
+		inferenceLatency.WithLabelValues(camera).Observe(r.Perf.Net / 1000)
+	}
+	if !captured.IsZero() {
+		frameLatency.WithLabelValues(camera).Observe(time.Since(captured).Seconds())
+	}
+}
+
+// recordOccupancy records occupancy n of parking lot monitored by camera
+func recordOccupancy(camera string, n int) {
+	occupancy.WithLabelValues(camera).Set(float64(n))
+}
+
+// recordQueue records queue q at the entry barrier monitored by camera
+func recordQueue(camera string, q *Queue) {
+	queueLength.WithLabelValues(camera).Set(float64(q.Length))
+	if q.Wait != nil {
+		queueWait.WithLabelValues(camera).Set(*q.Wait)
+	}
+}
+
+// recordDropped records a frame dropped by camera
+func recordDropped(camera string) {
+	framesDropped.WithLabelValues(camera).Inc()
+}
+
+// recordReidentification records a lost car re-identified by camera
+func recordReidentification(camera string) {
+	reidentifications.WithLabelValues(camera).Inc()
+}
+
+// recordPublish records result err of publishing message of type mt to MQTT server by camera
+func recordPublish(camera string, mt MessageType, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	mqttPublished.WithLabelValues(camera, string(mt), result).Inc()
+}
@@ -24,51 +24,223 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/eclipse/paho.golang/autopaho"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/youmark/pkcs8"
 )
 
 const (
 	// TIMEOUT is MQTT publish/subscribe timeout
 	TIMEOUT = 1 * time.Second
-	// QOS is Quality Of Service
+	// POLL is interval MQTT publish is checked for cancellation at
+	POLL = 100 * time.Millisecond
+	// QOS is default Quality Of Service
 	QOS = 1
+	// TOPIC is default MQTT topic template
+	TOPIC = "parking/counter"
+	// EXPIRY is default MQTT v5 expiry interval of totals messages in seconds
+	EXPIRY = 60
 )
 
-// MQTTClient is MQTT client
-type MQTTClient struct {
-	// MQTT.Client implements MQTT client
-	client MQTT.Client
+// MQTTTopicConfig overrides default MQTT publishing options for a particular message type
+type MQTTTopicConfig struct {
+	// Topic is MQTT topic template
+	Topic string `json:"topic"`
+	// QoS is Quality Of Service
+	QoS *int `json:"qos"`
+	// Retain instructs MQTT server to retain the last published message
+	Retain *bool `json:"retain"`
+	// Expiry is MQTT v5 message expiry interval in seconds
+	Expiry *int `json:"expiry"`
 }
 
-// MQTTNewTLSConfig creates MQTT TLS configuration and returns it
-// It returns error if it can't read TLS certificate files in provided paths.
-func MQTTNewTLSConfig(crtPath, keyPath string, skipVerify bool) (*tls.Config, error) {
-	// Import trusted certificates from CAfile.pem.
-	// Alternatively, manually add CA certificates to
-	// default openssl CA bundle.
-	certpool := x509.NewCertPool()
-	pemCerts, err := ioutil.ReadFile("samplecerts/CAfile.pem")
-	if err == nil {
-		certpool.AppendCertsFromPEM(pemCerts)
+// MQTTConfig is MQTT publishing configuration.
+// Topic templates can contain {site}, {lot}, {camera} and {type} placeholders
+// which are replaced with configured names and published message type.
+type MQTTConfig struct {
+	// Version is MQTT protocol version: 3 or 5
+	Version int `json:"version"`
+	// Topic is default MQTT topic template
+	Topic string `json:"topic"`
+	// QoS is default Quality Of Service
+	QoS int `json:"qos"`
+	// Retain is default message retain flag
+	Retain bool `json:"retain"`
+	// Messages overrides default options per message type
+	Messages map[MessageType]*MQTTTopicConfig `json:"messages"`
+	// MaxReconnectInterval is max number of seconds between reconnection attempts
+	MaxReconnectInterval int `json:"max_reconnect_interval"`
+	// ConnectRetries is number of times the initial connection is retried; -1 retries forever
+	ConnectRetries int `json:"connect_retries"`
+	// UserProperties are MQTT v5 user properties added to all published messages
+	UserProperties map[string]string `json:"user_properties"`
+}
+
+// NewMQTTConfig returns MQTT configuration populated with default values
+func NewMQTTConfig() *MQTTConfig {
+	return &MQTTConfig{
+		Version:  3,
+		Topic:    TOPIC,
+		QoS:      QOS,
+		Retain:   false,
+		Messages: make(map[MessageType]*MQTTTopicConfig),
+		// reconnect options
+		MaxReconnectInterval: 60,
+		ConnectRetries:       5,
 	}
+}
 
-	// Import client certificate/key pair
-	cert, err := tls.LoadX509KeyPair(crtPath, keyPath)
-	if err != nil {
-		return nil, err
+// Validate checks MQTT configuration is valid and returns error if it is not
+func (c *MQTTConfig) Validate() error {
+	if err := validateTopic(c.Topic); err != nil {
+		return err
+	}
+
+	if c.Version != 3 && c.Version != 5 {
+		return fmt.Errorf("Unsupported MQTT version: %d", c.Version)
+	}
+
+	if c.QoS < 0 || c.QoS > 2 {
+		return fmt.Errorf("Invalid MQTT QoS: %d", c.QoS)
 	}
 
+	if c.MaxReconnectInterval < 1 {
+		return fmt.Errorf("Invalid MQTT max reconnect interval: %d", c.MaxReconnectInterval)
+	}
+
+	if c.ConnectRetries < -1 {
+		return fmt.Errorf("Invalid MQTT connect retries: %d", c.ConnectRetries)
+	}
+
+	for mt, tc := range c.Messages {
+		if !mt.Valid() {
+			return fmt.Errorf("Unknown MQTT message type: %s", mt)
+		}
+
+		if tc == nil {
+			continue
+		}
+
+		if tc.Topic != "" {
+			if err := validateTopic(tc.Topic); err != nil {
+				return err
+			}
+		}
+
+		if tc.QoS != nil && (*tc.QoS < 0 || *tc.QoS > 2) {
+			return fmt.Errorf("Invalid MQTT QoS for %s messages: %d", mt, *tc.QoS)
+		}
+
+		if tc.Expiry != nil && *tc.Expiry < 0 {
+			return fmt.Errorf("Invalid MQTT expiry for %s messages: %d", mt, *tc.Expiry)
+		}
+	}
+
+	return nil
+}
+
+// validateTopic checks that topic template t is not empty, contains no wildcards and only known placeholders
+func validateTopic(t string) error {
+	if t == "" {
+		return fmt.Errorf("Invalid MQTT topic: can't be empty")
+	}
+
+	if strings.ContainsAny(t, "+#") {
+		return fmt.Errorf("Invalid MQTT topic %q: wildcards are not allowed", t)
+	}
+
+	r := strings.NewReplacer("{site}", "", "{lot}", "", "{camera}", "", "{type}", "")
+	if strings.ContainsAny(r.Replace(t), "{}") {
+		return fmt.Errorf("Invalid MQTT topic %q: unknown placeholder", t)
+	}
+
+	return nil
+}
+
+// MQTTState is MQTT connection state
+type MQTTState int
+
+const (
+	// CONNECTING means client is establishing initial connection
+	CONNECTING MQTTState = iota + 1
+	// CONNECTED means client is connected
+	CONNECTED
+	// RECONNECTING means client lost connection and is reconnecting
+	RECONNECTING
+	// DISCONNECTED means client has been disconnected
+	DISCONNECTED
+)
+
+// String implements fmt.Stringer for MQTTState
+func (s MQTTState) String() string {
+	switch s {
+	case CONNECTING:
+		return "CONNECTING"
+	case CONNECTED:
+		return "CONNECTED"
+	case RECONNECTING:
+		return "RECONNECTING"
+	case DISCONNECTED:
+		return "DISCONNECTED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// MQTTStatus is MQTT connection status
+type MQTTStatus struct {
+	// State is current connection state
+	State MQTTState
+	// Since is time of the last state change
+	Since time.Time
+	// Reconnects is number of successful reconnections
+	Reconnects int
+	// LastError is the last connection error
+	LastError error
+}
+
+// MQTTClient is MQTT client
+type MQTTClient struct {
+	// MQTT.Client implements MQTT v3 client
+	client MQTT.Client
+	// cm manages MQTT v5 connection
+	cm *autopaho.ConnectionManager
+	// stop cancels MQTT v5 connection context
+	stop context.CancelFunc
+	// config is MQTT publishing configuration
+	config *MQTTConfig
+	// names replaces site, lot and camera placeholders in topic templates
+	names *strings.Replacer
+	// mu protects status, subs and commands
+	mu sync.Mutex
+	// status is MQTT connection status
+	status MQTTStatus
+	// subs keeps subscribed topics so they can be restored on reconnect
+	subs map[string]byte
+	// commands handles received command messages
+	commands CommandHandler
+}
+
+// MQTTNewTLSConfig creates MQTT TLS configuration and returns it.
+// If caPath is empty the server certificate is verified using the system CA roots.
+// If both crtPath and keyPath are set, the certificate/key pair is used for client authentication.
+// Encrypted PEM private keys are decrypted with keyPass.
+// It returns error if it can't read or parse TLS certificate files in provided paths.
+func MQTTNewTLSConfig(caPath, crtPath, keyPath, keyPass string, skipVerify bool) (*tls.Config, error) {
 	// Create tls.Config with desired tls properties
-	return &tls.Config{
-		// RootCAs = certs used to verify server cert.
-		RootCAs: certpool,
+	tlsConfig := &tls.Config{
 		// ClientAuth = whether to request cert from server.
 		// Since the server is set up for SSL, this happens
 		// anyways.
@@ -78,23 +250,116 @@ func MQTTNewTLSConfig(crtPath, keyPath string, skipVerify bool) (*tls.Config, er
 		// InsecureSkipVerify = verify that cert contents
 		// match server. IP matches what is in cert etc.
 		InsecureSkipVerify: skipVerify,
-		// Certificates = list of certs client sends to server.
-		Certificates: []tls.Certificate{cert},
-	}, nil
+	}
+
+	// Import trusted CA certificates used to verify server cert.
+	// If none are provided, system CA roots are used.
+	if caPath != "" {
+		pemCerts, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA root certificate: %v", err)
+		}
+
+		certpool := x509.NewCertPool()
+		if ok := certpool.AppendCertsFromPEM(pemCerts); !ok {
+			return nil, fmt.Errorf("No valid PEM certificates found in CA root file %s", caPath)
+		}
+		// RootCAs = certs used to verify server cert.
+		tlsConfig.RootCAs = certpool
+	}
+
+	// server-only TLS
+	if crtPath == "" && keyPath == "" {
+		return tlsConfig, nil
+	}
+
+	if crtPath == "" || keyPath == "" {
+		return nil, fmt.Errorf("Both client certificate and its private key must be provided")
+	}
+
+	// Import client certificate/key pair
+	cert, err := loadX509KeyPair(crtPath, keyPath, keyPass)
+	if err != nil {
+		return nil, err
+	}
+	// Certificates = list of certs client sends to server.
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	return tlsConfig, nil
 }
 
+// loadX509KeyPair reads PEM encoded certificate and private key from crtPath and keyPath and returns them.
+// If the private key is encrypted it is decrypted using keyPass. Both encrypted PKCS#8 keys and legacy
+// encrypted PEM keys are supported; legacy PEM encryption is insecure and should only be used with old keys.
+// It returns error if either of the files can't be read or parsed, or if the key can't be decrypted.
+func loadX509KeyPair(crtPath, keyPath, keyPass string) (tls.Certificate, error) {
+	crtPEM, err := ioutil.ReadFile(crtPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Failed to read client certificate: %v", err)
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Failed to read client certificate private key: %v", err)
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("No PEM data found in client certificate private key %s", keyPath)
+	}
+
+	encrypted := block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block)
+	if encrypted && keyPass == "" {
+		return tls.Certificate{}, fmt.Errorf("Client certificate private key %s is encrypted but no password was provided", keyPath)
+	}
+
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(keyPass))
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("Failed to decrypt client certificate private key %s: %v", keyPath, err)
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("Invalid client certificate private key %s: %v", keyPath, err)
+		}
+
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	case x509.IsEncryptedPEMBlock(block):
+		der, err := x509.DecryptPEMBlock(block, []byte(keyPass))
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("Failed to decrypt client certificate private key %s: %v", keyPath, err)
+		}
+
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+
+	cert, err := tls.X509KeyPair(crtPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Invalid client certificate/key pair: %v", err)
+	}
+
+	return cert, nil
+}
+
+// tlsSchemes are MQTT server URI schemes which require TLS connection
+var tlsSchemes = []string{"ssl://", "tls://", "tcps://", "wss://"}
+
 // MQTTClientOptions creates new MQTT client options and returns it
 // It reads the following environment variables to populate the options:
 // MQTT_SERVER: URI address of MQTT server; required parameter
 // MQTT_CLIENT_ID: MQTT client ID; required parameter
 // MQTT_USERNAME: MQTT username; not required
 // MQTT_PASSWORD: MQTT password for MQTT_USERNAME; not required
-// MQTT_CERT: SSL certificate; not required
-// MQTT_CERT_KEY: SSL certificate private key; not required
+// MQTT_CERT: SSL client certificate; not required
+// MQTT_CERT_KEY: SSL client certificate private key; not required
+// MQTT_CERT_KEY_PASSWORD: password of encrypted SSL client certificate private key; not required
 // MQTT_CA_ROOT: SSL CA root certificate; not required
 // MQTT_TLS_SKIP_VERIFY: SSL TLS verification; not required
-// It returns error if either MQTT server was not specified or if
-// the MQTT client ID is missing in the client configuration options.
+// TLS is enabled if MQTT_SERVER uses ssl, tls, tcps or wss scheme or if any of the TLS options is set.
+// It returns error if either MQTT server was not specified, if the MQTT client ID
+// is missing in the client configuration options or if TLS configuration is invalid.
 func MQTTClientOptions() (*MQTT.ClientOptions, error) {
 	// read config options from environment variables
 	server := os.Getenv("MQTT_SERVER")
@@ -103,6 +368,7 @@ func MQTTClientOptions() (*MQTT.ClientOptions, error) {
 	password := os.Getenv("MQTT_PASSWORD")
 	tlsCert := os.Getenv("MQTT_CERT")
 	tlsKey := os.Getenv("MQTT_CERT_KEY")
+	tlsKeyPass := os.Getenv("MQTT_CERT_KEY_PASSWORD")
 	tlsCA := os.Getenv("MQTT_CA_ROOT")
 	tlsSkipVerify := os.Getenv("MQTT_TLS_SKIP_VERIFY")
 
@@ -132,8 +398,15 @@ func MQTTClientOptions() (*MQTT.ClientOptions, error) {
 		skipVerify = true
 	}
 
-	if tlsCert != "" && tlsKey != "" && tlsCA != "" {
-		tlsConfig, err := MQTTNewTLSConfig(tlsCert, tlsKey, skipVerify)
+	useTLS := tlsCert != "" || tlsKey != "" || tlsCA != "" || skipVerify
+	for _, scheme := range tlsSchemes {
+		if strings.HasPrefix(strings.ToLower(server), scheme) {
+			useTLS = true
+		}
+	}
+
+	if useTLS {
+		tlsConfig, err := MQTTNewTLSConfig(tlsCA, tlsCert, tlsKey, tlsKeyPass, skipVerify)
 		if err != nil {
 			return nil, fmt.Errorf("Invalid TLS configuration: %s", err)
 		}
@@ -144,30 +417,251 @@ func MQTTClientOptions() (*MQTT.ClientOptions, error) {
 }
 
 // MQTTConnect attempts to connect to MQTT server and returns MQTT client
+// Topics of published messages are rendered from MQTT configuration in cfg.
+// If cfg.MQTT.Version is 5, the client connects using MQTT v5 protocol.
+// The initial connection is retried with exponential backoff cfg.MQTT.ConnectRetries times
+// or until ctx is cancelled.
+// Once connected, the client automatically reconnects when the connection is lost
+// and restores its subscriptions.
 // It returns error if it fails to connect to the MQTT server.
-func MQTTConnect(opts *MQTT.ClientOptions) (*MQTTClient, error) {
-	c := MQTT.NewClient(opts)
+func MQTTConnect(ctx context.Context, opts *MQTT.ClientOptions, cfg *Config) (*MQTTClient, error) {
+	c := &MQTTClient{
+		config: cfg.MQTT,
+		names:  strings.NewReplacer("{site}", cfg.Site, "{lot}", cfg.Lot, "{camera}", cfg.Camera),
+		status: MQTTStatus{State: CONNECTING, Since: time.Now()},
+		subs:   make(map[string]byte),
+	}
 
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+	if cfg.MQTT.Version == 5 {
+		if err := c.connect5(ctx, opts); err != nil {
+			return nil, err
+		}
+
+		return c, nil
 	}
 
-	return &MQTTClient{
-		client: c,
-	}, nil
+	maxInterval := time.Duration(cfg.MQTT.MaxReconnectInterval) * time.Second
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(maxInterval)
+	opts.SetOnConnectHandler(c.onConnect)
+	opts.SetConnectionLostHandler(func(client MQTT.Client, err error) {
+		c.connectionLost(err)
+	})
+
+	c.client = MQTT.NewClient(opts)
+
+	sleep := 1 * time.Second
+	for retry := 0; ; retry++ {
+		token := c.client.Connect()
+		if token.Wait() && token.Error() == nil {
+			break
+		}
+
+		c.setState(CONNECTING, token.Error())
+		if cfg.MQTT.ConnectRetries != -1 && retry >= cfg.MQTT.ConnectRetries {
+			return nil, token.Error()
+		}
+
+		fmt.Printf("Failed to connect to MQTT server: %v. Retrying in %s\n", token.Error(), sleep)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if sleep *= 2; sleep > maxInterval {
+			sleep = maxInterval
+		}
+	}
+
+	return c, nil
 }
 
-// Publish publishes message to topic
-// It returns MQTT connection Token
-func (c *MQTTClient) Publish(topic, message string) (MQTT.Token, error) {
-	token := c.client.Publish(topic, QOS, false, message)
+// onConnect is called by MQTT client whenever connection to MQTT server is established.
+// It restores all the subscriptions when the client reconnects.
+func (c *MQTTClient) onConnect(client MQTT.Client) {
+	subs, reconnect := c.connectionUp()
+	if !reconnect {
+		return
+	}
 
-	// wait for publish to finish
-	if ok := token.WaitTimeout(TIMEOUT); ok && token.Error() != nil {
-		return nil, token.Error()
+	for topic, qos := range subs {
+		token := client.Subscribe(topic, qos, c.onCommand)
+		if ok := token.WaitTimeout(TIMEOUT); ok && token.Error() != nil {
+			fmt.Printf("Error restoring MQTT subscription to %s: %v\n", topic, token.Error())
+		}
+	}
+}
+
+// connectionUp records the connection to MQTT server has been established.
+// It returns the subscriptions to restore and true if the connection was re-established.
+func (c *MQTTClient) connectionUp() (map[string]byte, bool) {
+	c.mu.Lock()
+	reconnect := c.status.State == RECONNECTING
+	if reconnect {
+		c.status.Reconnects++
+	}
+	subs := make(map[string]byte, len(c.subs))
+	for topic, qos := range c.subs {
+		subs[topic] = qos
+	}
+	c.mu.Unlock()
+
+	c.setState(CONNECTED, nil)
+	fmt.Printf("MQTT connection state: %s\n", CONNECTED)
+
+	return subs, reconnect
+}
+
+// connectionLost records the connection to MQTT server has been lost due to err
+func (c *MQTTClient) connectionLost(err error) {
+	c.setState(RECONNECTING, err)
+	fmt.Printf("MQTT connection state: %s: %v\n", RECONNECTING, err)
+}
+
+// setState sets MQTT connection state to s and records connection error err if it is not nil
+func (c *MQTTClient) setState(s MQTTState, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.status.State != s {
+		c.status.State = s
+		c.status.Since = time.Now()
+	}
+
+	if err != nil {
+		c.status.LastError = err
+	}
+}
+
+// Status returns MQTT connection status
+func (c *MQTTClient) Status() MQTTStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status
+}
+
+// MQTTTopic is MQTT topic and publishing options of particular message type
+type MQTTTopic struct {
+	// Name is MQTT topic name
+	Name string
+	// QoS is Quality Of Service
+	QoS byte
+	// Retain is message retain flag
+	Retain bool
+	// Expiry is message expiry interval in seconds; 0 means messages never expire
+	Expiry int
+}
+
+// Topic returns MQTT topic and its publishing options configured for message type mt
+func (c *MQTTClient) Topic(mt MessageType) MQTTTopic {
+	topic, qos, retain := c.config.Topic, c.config.QoS, c.config.Retain
+	// periodic totals are stale once newer ones are published
+	expiry := 0
+	if mt == TotalsMessage {
+		expiry = EXPIRY
+	}
+
+	if tc, ok := c.config.Messages[mt]; ok && tc != nil {
+		if tc.Topic != "" {
+			topic = tc.Topic
+		}
+		if tc.QoS != nil {
+			qos = *tc.QoS
+		}
+		if tc.Retain != nil {
+			retain = *tc.Retain
+		}
+		if tc.Expiry != nil {
+			expiry = *tc.Expiry
+		}
+	}
+
+	return MQTTTopic{
+		Name:   strings.Replace(c.names.Replace(topic), "{type}", string(mt), -1),
+		QoS:    byte(qos),
+		Retain: retain,
+		Expiry: expiry,
 	}
+}
 
-	return token, nil
+// PublishMessage publishes message of type mt to the topic configured for it.
+// MQTT v5 messages carry content type, expiry, user properties and response topic properties.
+// It returns error if the message fails to be published or if ctx is cancelled before it's published.
+func (c *MQTTClient) PublishMessage(ctx context.Context, mt MessageType, message string) error {
+	t := c.Topic(mt)
+
+	if c.cm != nil {
+		return c.publish5(ctx, t.Name, t.QoS, t.Retain, []byte(message), c.properties5(mt, t))
+	}
+
+	return c.Publish(ctx, t.Name, t.QoS, t.Retain, message)
+}
+
+// Publish publishes message to topic with qos and retain flag
+// It returns error if the message fails to be published, isn't acknowledged within TIMEOUT
+// or if ctx is cancelled before it's published.
+func (c *MQTTClient) Publish(ctx context.Context, topic string, qos byte, retain bool, message string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if c.cm != nil {
+		return c.publish5(ctx, topic, qos, retain, []byte(message), nil)
+	}
+
+	token := c.client.Publish(topic, qos, retain, message)
+
+	// wait for publish to finish; the token can't be waited on together with ctx so poll it
+	deadline := time.Now().Add(TIMEOUT)
+	for !token.WaitTimeout(POLL) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out publishing to %s", topic)
+		}
+	}
+
+	return token.Error()
+}
+
+// CommandHandler handles command received in payload and returns response to it.
+// Returned response is published to the response topic of MQTT v5 command messages.
+type CommandHandler func(payload []byte) ([]byte, error)
+
+// SetCommandHandler sets handler h of received command messages
+func (c *MQTTClient) SetCommandHandler(h CommandHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.commands = h
+}
+
+// handleCommand passes command received on topic to command handler and returns its response.
+// It returns nil if no command handler has been set.
+func (c *MQTTClient) handleCommand(topic string, payload []byte) []byte {
+	fmt.Printf("MQTT message received. Topic: %s Message: %s\n", topic, payload)
+
+	c.mu.Lock()
+	h := c.commands
+	c.mu.Unlock()
+
+	if h == nil {
+		return nil
+	}
+
+	resp, err := h(payload)
+	if err != nil {
+		resp, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+
+	return resp
+}
+
+// onCommand handles messages received on subscribed command topics
+func (c *MQTTClient) onCommand(client MQTT.Client, msg MQTT.Message) {
+	c.handleCommand(msg.Topic(), msg.Payload())
 }
 
 // msgHandler for MQTT subscription for any desired control channel topic
@@ -175,20 +669,72 @@ func msgHandler(c MQTT.Client, msg MQTT.Message) {
 	fmt.Printf("MQTT message received. Topic: %s Message: %s", msg.Topic(), msg.Payload())
 }
 
-// Subscribe subscribes to specified topic
-// It returns MQTT connection Token
-func (c *MQTTClient) Subscribe(topic string) (MQTT.Token, error) {
-	token := c.client.Subscribe(topic, QOS, msgHandler)
+// Subscribe subscribes to specified topic with qos
+// The subscription is restored whenever the client reconnects to MQTT server.
+// It returns error if the subscription fails.
+func (c *MQTTClient) Subscribe(topic string, qos byte) error {
+	c.mu.Lock()
+	c.subs[topic] = qos
+	c.mu.Unlock()
+
+	if c.cm != nil {
+		return subscribe5(c.cm, topic, qos)
+	}
+
+	token := c.client.Subscribe(topic, qos, c.onCommand)
 
 	// wait for the subscription to finish
 	if ok := token.WaitTimeout(TIMEOUT); ok && token.Error() != nil {
-		return nil, token.Error()
+		return token.Error()
+	}
+
+	return nil
+}
+
+// SubscribeCommands subscribes to the topic configured for command messages.
+// It does nothing if no command topic has been configured.
+// It returns error if the subscription fails.
+func (c *MQTTClient) SubscribeCommands() error {
+	if tc, ok := c.config.Messages[CommandMessage]; !ok || tc == nil || tc.Topic == "" {
+		return nil
+	}
+
+	t := c.Topic(CommandMessage)
+	if err := c.Subscribe(t.Name, t.QoS); err != nil {
+		return fmt.Errorf("Failed to subscribe to %s: %v", t.Name, err)
 	}
 
-	return token, nil
+	return nil
+}
+
+// MQTTPublisher publishes messages to MQTT server
+type MQTTPublisher struct {
+	// client is MQTT client
+	client *MQTTClient
+}
+
+// Publish publishes message m to the MQTT topic configured for its type
+// It returns error if the message fails to be published.
+func (p *MQTTPublisher) Publish(ctx context.Context, m *Message) error {
+	err := p.client.PublishMessage(ctx, m.Type, string(m.Payload))
+	recordPublish(config.Camera, m.Type, err)
+
+	return err
+}
+
+// Close disconnects from MQTT server
+func (p *MQTTPublisher) Close() error {
+	p.client.Disconnect(100)
+
+	return nil
 }
 
 // Disconnect closes the connection to MQTT broker, waiting for pending ms.
 func (c *MQTTClient) Disconnect(pending uint) {
-	c.client.Disconnect(pending)
+	if c.cm != nil {
+		c.disconnect5(pending)
+	} else {
+		c.client.Disconnect(pending)
+	}
+	c.setState(DISCONNECTED, nil)
 }
@@ -0,0 +1,268 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// contentType is content type of published MQTT v5 messages
+	contentType = "application/json"
+)
+
+// connect5 connects to MQTT server using MQTT v5 protocol and connection options in opts.
+// The initial connection is retried with exponential backoff c.config.ConnectRetries times
+// or until start is cancelled.
+// Once connected, the connection is automatically re-established when it's lost.
+// It returns error if it fails to connect to the MQTT server.
+func (c *MQTTClient) connect5(start context.Context, opts *MQTT.ClientOptions) error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	maxInterval := time.Duration(c.config.MaxReconnectInterval) * time.Second
+	// mu protects sleep, connected and attempts as connection callbacks run in autopaho goroutines
+	var mu sync.Mutex
+	// sleep is backoff delay between connection attempts
+	sleep := 1 * time.Second
+	// connected is set once the initial connection has been established
+	connected := false
+	// attempts counts failed initial connection attempts
+	attempts := 0
+	// failed receives the error when initial connection retries are exhausted
+	failed := make(chan error, 1)
+
+	cfg := autopaho.ClientConfig{
+		BrokerUrls: opts.Servers,
+		TlsCfg:     &opts.TLSConfig,
+		KeepAlive:  uint16(opts.KeepAlive),
+		// backoff is handled in OnConnectError
+		ConnectRetryDelay: 1 * time.Millisecond,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
+			mu.Lock()
+			connected = true
+			sleep = 1 * time.Second
+			mu.Unlock()
+
+			// MQTT v5 sessions are started clean so subscriptions are restored on every connection
+			subs, _ := c.connectionUp()
+			for topic, qos := range subs {
+				if err := subscribe5(cm, topic, qos); err != nil {
+					fmt.Printf("Error restoring MQTT subscription to %s: %v\n", topic, err)
+				}
+			}
+		},
+		OnConnectError: func(err error) {
+			c.mu.Lock()
+			c.status.LastError = err
+			c.mu.Unlock()
+
+			mu.Lock()
+			if !connected {
+				attempts++
+			}
+			exhausted := !connected && c.config.ConnectRetries != -1 && attempts > c.config.ConnectRetries
+			delay := sleep
+			if sleep *= 2; sleep > maxInterval {
+				sleep = maxInterval
+			}
+			mu.Unlock()
+
+			if exhausted {
+				select {
+				case failed <- err:
+				default:
+				}
+				// wait for the connection to be cancelled
+				<-ctx.Done()
+				return
+			}
+
+			fmt.Printf("Failed to connect to MQTT server: %v. Retrying in %s\n", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: opts.ClientID,
+			Router:   paho.NewSingleHandlerRouter(c.onCommand5),
+			OnClientError: func(err error) {
+				c.connectionLost(err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				c.connectionLost(fmt.Errorf("server disconnected with reason code %d", d.ReasonCode))
+			},
+		},
+	}
+
+	if opts.Username != "" {
+		cfg.SetUsernamePassword(opts.Username, []byte(opts.Password))
+	}
+
+	cm, err := autopaho.NewConnection(ctx, cfg)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	up := make(chan error, 1)
+	go func() {
+		up <- cm.AwaitConnection(ctx)
+	}()
+
+	select {
+	case err := <-up:
+		if err != nil {
+			cancel()
+			return err
+		}
+	case err := <-failed:
+		cancel()
+		return err
+	case <-start.Done():
+		cancel()
+		return start.Err()
+	}
+
+	c.cm = cm
+	c.stop = cancel
+
+	return nil
+}
+
+// properties5 returns MQTT v5 properties of message type mt published to topic t.
+// Messages carry JSON content type, expiry interval, site, lot, camera and message type
+// user properties as well as configured user properties.
+// If command topic is configured, it is advertised as message response topic.
+func (c *MQTTClient) properties5(mt MessageType, t MQTTTopic) *paho.PublishProperties {
+	format := byte(1)
+	props := &paho.PublishProperties{
+		ContentType:   contentType,
+		PayloadFormat: &format,
+	}
+
+	if t.Expiry > 0 {
+		expiry := uint32(t.Expiry)
+		props.MessageExpiry = &expiry
+	}
+
+	props.User.Add("site", c.names.Replace("{site}"))
+	props.User.Add("lot", c.names.Replace("{lot}"))
+	props.User.Add("camera", c.names.Replace("{camera}"))
+	props.User.Add("type", string(mt))
+
+	keys := make([]string, 0, len(c.config.UserProperties))
+	for key := range c.config.UserProperties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		props.User.Add(key, c.names.Replace(c.config.UserProperties[key]))
+	}
+
+	if tc, ok := c.config.Messages[CommandMessage]; ok && tc != nil && tc.Topic != "" {
+		props.ResponseTopic = c.Topic(CommandMessage).Name
+	}
+
+	return props
+}
+
+// publish5 publishes payload with MQTT v5 properties props to topic with qos and retain flag.
+// If props is nil, the message is published with JSON content type only.
+// It returns error if the message fails to be published within TIMEOUT or if ctx is cancelled.
+func (c *MQTTClient) publish5(ctx context.Context, topic string, qos byte, retain bool, payload []byte,
+	props *paho.PublishProperties) error {
+	if props == nil {
+		props = &paho.PublishProperties{ContentType: contentType}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, TIMEOUT)
+	defer cancel()
+
+	_, err := c.cm.Publish(ctx, &paho.Publish{
+		Topic:      topic,
+		QoS:        qos,
+		Retain:     retain,
+		Payload:    payload,
+		Properties: props,
+	})
+
+	return err
+}
+
+// subscribe5 subscribes to MQTT v5 topic with qos using connection manager cm
+// It returns error if the subscription fails.
+func subscribe5(cm *autopaho.ConnectionManager, topic string, qos byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+
+	_, err := cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: topic, QoS: qos},
+		},
+	})
+
+	return err
+}
+
+// onCommand5 handles MQTT v5 messages received on subscribed command topics.
+// If the command carries a response topic, the command response is published to it
+// along with the command correlation data.
+func (c *MQTTClient) onCommand5(p *paho.Publish) {
+	resp := c.handleCommand(p.Topic, p.Payload)
+	if resp == nil || p.Properties == nil || p.Properties.ResponseTopic == "" {
+		return
+	}
+
+	props := &paho.PublishProperties{
+		ContentType:     contentType,
+		CorrelationData: p.Properties.CorrelationData,
+	}
+
+	// publish from a new goroutine as the router must not block waiting for acknowledgement
+	go func() {
+		if err := c.publish5(context.Background(), p.Properties.ResponseTopic, p.QoS, false, resp, props); err != nil {
+			fmt.Printf("Error publishing command response to %s: %v\n", p.Properties.ResponseTopic, err)
+		}
+	}()
+}
+
+// disconnect5 closes MQTT v5 connection, waiting for pending ms.
+func (c *MQTTClient) disconnect5(pending uint) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(pending)*time.Millisecond)
+	defer cancel()
+
+	if err := c.cm.Disconnect(ctx); err != nil {
+		fmt.Printf("Error disconnecting from MQTT server: %v\n", err)
+	}
+	c.stop()
+}
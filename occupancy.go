@@ -0,0 +1,207 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"time"
+)
+
+// OccupancyConfig is configuration of parking lot capacity and occupancy states
+type OccupancyConfig struct {
+	// Capacity is number of parking spaces; occupancy is not limited and states are not tracked if 0
+	Capacity int `json:"capacity"`
+	// AlmostFull is occupancy at which the parking lot becomes almost full; defaults to 90% of capacity
+	AlmostFull int `json:"almost_full"`
+	// Hysteresis is number of cars occupancy must drop below a threshold by to leave its state;
+	// defaults to 2% of capacity, at least 1
+	Hysteresis int `json:"hysteresis"`
+}
+
+// Validate checks occupancy configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *OccupancyConfig) Validate() error {
+	if c.Capacity < 0 {
+		return fmt.Errorf("Invalid capacity: %d", c.Capacity)
+	}
+	if c.Capacity == 0 {
+		return nil
+	}
+
+	if c.AlmostFull < 0 || c.AlmostFull > c.Capacity {
+		return fmt.Errorf("Invalid almost full threshold %d: must be between 0 and capacity %d", c.AlmostFull, c.Capacity)
+	}
+	if c.AlmostFull == 0 {
+		c.AlmostFull = c.Capacity * 9 / 10
+	}
+
+	if c.Hysteresis < 0 {
+		return fmt.Errorf("Invalid hysteresis: %d", c.Hysteresis)
+	}
+	if c.Hysteresis == 0 {
+		c.Hysteresis = c.Capacity / 50
+		if c.Hysteresis < 1 {
+			c.Hysteresis = 1
+		}
+	}
+
+	return nil
+}
+
+// OccupancyState is parking lot occupancy state
+type OccupancyState int
+
+const (
+	// AVAILABLE means there are free parking spaces
+	AVAILABLE OccupancyState = iota + 1
+	// ALMOST_FULL means there are only a few free parking spaces
+	ALMOST_FULL
+	// FULL means there are no free parking spaces
+	FULL
+)
+
+// String implements fmt.Stringer for OccupancyState
+func (s OccupancyState) String() string {
+	switch s {
+	case AVAILABLE:
+		return "AVAILABLE"
+	case ALMOST_FULL:
+		return "ALMOST_FULL"
+	case FULL:
+		return "FULL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler for OccupancyState
+func (s OccupancyState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler for OccupancyState
+func (s *OccupancyState) UnmarshalText(text []byte) error {
+	for _, state := range []OccupancyState{AVAILABLE, ALMOST_FULL, FULL} {
+		if string(text) == state.String() {
+			*s = state
+			return nil
+		}
+	}
+	*s = 0
+
+	return nil
+}
+
+// Color returns color of occupancy state used in video overlay
+func (s OccupancyState) Color() color.RGBA {
+	switch s {
+	case AVAILABLE:
+		return color.RGBA{0, 255, 0, 0}
+	case ALMOST_FULL:
+		return color.RGBA{255, 165, 0, 0}
+	case FULL:
+		return color.RGBA{255, 0, 0, 0}
+	default:
+		return color.RGBA{255, 255, 255, 0}
+	}
+}
+
+// nextState returns occupancy state following state s at occupancy n with thresholds in oc.
+// A state is entered once occupancy reaches its threshold and left once occupancy drops
+// hysteresis below it so that the state does not flap when a car hovers at the entrance.
+func nextState(s OccupancyState, n int, oc *OccupancyConfig) OccupancyState {
+	switch {
+	case n >= oc.Capacity:
+		return FULL
+	case s == FULL && n > oc.Capacity-oc.Hysteresis:
+		return FULL
+	case n >= oc.AlmostFull:
+		return ALMOST_FULL
+	case (s == FULL || s == ALMOST_FULL) && n > oc.AlmostFull-oc.Hysteresis:
+		return ALMOST_FULL
+	default:
+		return AVAILABLE
+	}
+}
+
+// OccupancyChange is an event of parking lot occupancy state change
+type OccupancyChange struct {
+	// Time is time of the change
+	Time time.Time `json:"time"`
+	// Camera is name of the camera monitoring the parking lot
+	Camera string `json:"camera"`
+	// State is the new occupancy state
+	State OccupancyState `json:"state"`
+	// Previous is the previous occupancy state
+	Previous OccupancyState `json:"previous"`
+	// Occupancy is number of cars parked in the parking lot
+	Occupancy int `json:"occupancy"`
+	// Capacity is number of parking spaces
+	Capacity int `json:"capacity"`
+}
+
+// Clamp keeps parking lot occupancy between 0 and capacity by adjusting the baseline.
+// Capacity of 0 means the occupancy is not limited from above.
+// It returns the correction made to the occupancy.
+func (p *ParkingLot) Clamp(capacity int) int {
+	n := p.Occupancy()
+
+	correction := 0
+	if n < 0 {
+		correction = -n
+	}
+	if capacity > 0 && n > capacity {
+		correction = capacity - n
+	}
+
+	p.Baseline += correction
+
+	return correction
+}
+
+// UpdateState updates parking lot occupancy state using thresholds in oc.
+// It returns the state change or nil if the state hasn't changed or capacity is not configured.
+func (p *ParkingLot) UpdateState(oc *OccupancyConfig) *OccupancyChange {
+	if oc.Capacity == 0 {
+		return nil
+	}
+
+	state := nextState(p.State, p.Occupancy(), oc)
+	if state == p.State {
+		return nil
+	}
+
+	change := &OccupancyChange{
+		Time:      time.Now(),
+		Camera:    config.Camera,
+		State:     state,
+		Previous:  p.State,
+		Occupancy: p.Occupancy(),
+		Capacity:  oc.Capacity,
+	}
+	p.State = state
+
+	return change
+}
@@ -0,0 +1,145 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestOccupancyConfigValidate(t *testing.T) {
+	tests := []struct {
+		config     OccupancyConfig
+		almostFull int
+		hysteresis int
+		fail       bool
+	}{
+		{OccupancyConfig{}, 0, 0, false},
+		{OccupancyConfig{Capacity: 100}, 90, 2, false},
+		{OccupancyConfig{Capacity: 10}, 9, 1, false},
+		{OccupancyConfig{Capacity: 100, AlmostFull: 80, Hysteresis: 5}, 80, 5, false},
+		{OccupancyConfig{Capacity: -1}, 0, 0, true},
+		{OccupancyConfig{Capacity: 100, AlmostFull: 101}, 0, 0, true},
+		{OccupancyConfig{Capacity: 100, Hysteresis: -1}, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		c := tt.config
+		err := c.Validate()
+		if (err != nil) != tt.fail {
+			t.Errorf("Validate() of %+v error = %v, want failure %v", tt.config, err, tt.fail)
+			continue
+		}
+		if err == nil && (c.AlmostFull != tt.almostFull || c.Hysteresis != tt.hysteresis) {
+			t.Errorf("Validate() of %+v = almost full %d hysteresis %d, want %d %d", tt.config, c.AlmostFull,
+				c.Hysteresis, tt.almostFull, tt.hysteresis)
+		}
+	}
+}
+
+func TestNextState(t *testing.T) {
+	oc := &OccupancyConfig{Capacity: 100, AlmostFull: 90, Hysteresis: 2}
+
+	tests := []struct {
+		state     OccupancyState
+		occupancy int
+		want      OccupancyState
+	}{
+		{0, 0, AVAILABLE},
+		{0, 95, ALMOST_FULL},
+		{0, 100, FULL},
+		{AVAILABLE, 89, AVAILABLE},
+		{AVAILABLE, 90, ALMOST_FULL},
+		{AVAILABLE, 100, FULL},
+		{AVAILABLE, 120, FULL},
+		{ALMOST_FULL, 90, ALMOST_FULL},
+		{ALMOST_FULL, 89, ALMOST_FULL},
+		{ALMOST_FULL, 88, AVAILABLE},
+		{ALMOST_FULL, 99, ALMOST_FULL},
+		{ALMOST_FULL, 100, FULL},
+		{FULL, 99, FULL},
+		{FULL, 98, ALMOST_FULL},
+		{FULL, 89, ALMOST_FULL},
+		{FULL, 88, AVAILABLE},
+	}
+
+	for _, tt := range tests {
+		if got := nextState(tt.state, tt.occupancy, oc); got != tt.want {
+			t.Errorf("nextState(%s, %d) = %s, want %s", tt.state, tt.occupancy, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateStateHysteresis(t *testing.T) {
+	config = NewConfig()
+	oc := &OccupancyConfig{Capacity: 10, AlmostFull: 8, Hysteresis: 2}
+
+	// a car hovering at the entrance changes the occupancy back and forth
+	occupancies := []int{7, 8, 7, 8, 7, 10, 9, 10, 9, 8, 7, 6, 5}
+	want := []OccupancyState{AVAILABLE, ALMOST_FULL, ALMOST_FULL, ALMOST_FULL, ALMOST_FULL, FULL, FULL, FULL, FULL,
+		ALMOST_FULL, ALMOST_FULL, AVAILABLE, AVAILABLE}
+
+	p := &ParkingLot{}
+	changes := 0
+	for i, n := range occupancies {
+		p.SetOccupancy(n)
+		if p.UpdateState(oc) != nil {
+			changes++
+		}
+		if p.State != want[i] {
+			t.Errorf("state at occupancy %d (step %d) = %s, want %s", n, i, p.State, want[i])
+		}
+	}
+	if changes != 5 {
+		t.Errorf("state changed %d times, want 5", changes)
+	}
+}
+
+func TestClamp(t *testing.T) {
+	tests := []struct {
+		name       string
+		lot        ParkingLot
+		capacity   int
+		correction int
+		occupancy  int
+	}{
+		{"within capacity", ParkingLot{Baseline: 5, TotalIn: 3, TotalOut: 2}, 10, 0, 6},
+		{"negative", ParkingLot{Baseline: 1, TotalIn: 0, TotalOut: 3}, 10, 2, 0},
+		{"over capacity", ParkingLot{Baseline: 8, TotalIn: 5, TotalOut: 1}, 10, -2, 10},
+		{"unlimited capacity", ParkingLot{Baseline: 8, TotalIn: 50}, 0, 0, 58},
+		{"negative with unlimited capacity", ParkingLot{TotalOut: 4}, 0, 4, 0},
+	}
+
+	for _, tt := range tests {
+		p := tt.lot
+		if got := p.Clamp(tt.capacity); got != tt.correction {
+			t.Errorf("%s: Clamp() = %d, want %d", tt.name, got, tt.correction)
+		}
+		if p.Occupancy() != tt.occupancy {
+			t.Errorf("%s: occupancy = %d, want %d", tt.name, p.Occupancy(), tt.occupancy)
+		}
+		if p.TotalIn != tt.lot.TotalIn || p.TotalOut != tt.lot.TotalOut {
+			t.Errorf("%s: Clamp() changed in and out counters", tt.name)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// PersistConfig is configuration of parking lot state persistence
+type PersistConfig struct {
+	// Path is path to the file parking lot state is saved to; the state is not saved if empty
+	Path string `json:"path"`
+	// Interval is number of seconds between state saves; defaults to 10
+	Interval float64 `json:"interval"`
+}
+
+// Validate checks persistence configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *PersistConfig) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("Invalid state save interval: %f", c.Interval)
+	}
+	if c.Interval == 0 {
+		c.Interval = 10
+	}
+
+	return nil
+}
+
+// LoadParkingLot restores parking lot counters saved in file in path and returns the parking lot.
+// If the file does not exist, new parking lot is returned.
+// It returns error if the file can't be read or parsed.
+func LoadParkingLot(path string) (*ParkingLot, error) {
+	p := &ParkingLot{ResetAt: time.Now()}
+	if path == "" {
+		return p, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+
+	var t Totals
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+
+	p.TotalIn = t.In
+	p.TotalOut = t.Out
+	p.Baseline = t.Baseline
+	if !t.ResetAt.IsZero() {
+		p.ResetAt = t.ResetAt
+	}
+	if len(t.Gates) > 0 {
+		p.Gates = make(map[string]*GateTotals, len(t.Gates))
+		for name, g := range t.Gates {
+			g := g
+			p.Gates[name] = &g
+		}
+	}
+
+	return p, nil
+}
+
+// SaveTotals atomically saves parking lot counters t to file in path
+// It returns error if the file can't be written.
+func SaveTotals(path string, t Totals) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// writeFileAtomic writes data to file in path so that the file either keeps its old content or contains whole data.
+// The data is written to a temporary file which is synced to disk and renamed over the file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// remove the temporary file if anything fails; it's gone after successful rename
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	// sync the directory so that the rename survives power loss
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// persistRunner saves parking lot counters kept in state to file configured in pc at configured interval.
+// The counters are only saved when they change.
+// doneChan is used to receive a signal from the main goroutine to notify the routine to stop and return
+func persistRunner(doneChan <-chan struct{}, state *State, pc *PersistConfig) error {
+	ticker := time.NewTicker(time.Duration(pc.Interval * float64(time.Second)))
+	defer ticker.Stop()
+
+	saved := state.Totals()
+	for {
+		select {
+		case <-ticker.C:
+			t := state.Totals()
+			if t.In == saved.In && t.Out == saved.Out && t.Baseline == saved.Baseline && t.ResetAt.Equal(saved.ResetAt) &&
+				reflect.DeepEqual(t.Gates, saved.Gates) {
+				continue
+			}
+			if err := SaveTotals(pc.Path, t); err != nil {
+				fmt.Printf("Error saving parking lot state: %v\n", err)
+				continue
+			}
+			saved = t
+		case <-doneChan:
+			fmt.Printf("Stopping persistRunner: received stop signal\n")
+			return nil
+		}
+	}
+}
@@ -0,0 +1,310 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	// plausibleWindow is time window the peak speed of tracks is measured over
+	plausibleWindow = time.Second
+	// priorsSaveEvery is number of learned detections after which the priors are saved
+	priorsSaveEvery = 100
+)
+
+// PlausibilityConfig is configuration of suppression of pedestrians and other objects which are not cars
+type PlausibilityConfig struct {
+	// Classes are class labels of cars output by the detection model; labels are ignored if empty
+	Classes []int `json:"classes"`
+	// MinSamples is number of detections priors are learned from before they apply; priors are disabled if 0
+	MinSamples int `json:"min_samples"`
+	// AspectSigma is max number of standard deviations of detection aspect ratio from the learned mean; defaults to 3
+	AspectSigma float64 `json:"aspect_sigma"`
+	// SizeTolerance is max ratio of detection height to height learned at its position and vice versa; defaults to 2
+	SizeTolerance float64 `json:"size_tolerance"`
+	// PriorsFile is file the learned priors are saved to and loaded from; priors are learned from scratch if empty
+	PriorsFile string `json:"priors_file"`
+	// MinSpeed is min peak speed in pixels per second of a track to be counted
+	MinSpeed float64 `json:"min_speed"`
+	// MinPath is min distance in pixels between the first and the last point of a track to be counted
+	MinPath float64 `json:"min_path"`
+}
+
+// Validate checks plausibility configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *PlausibilityConfig) Validate() error {
+	if c.MinSamples < 0 {
+		return fmt.Errorf("Invalid plausibility min samples: %d", c.MinSamples)
+	}
+
+	if c.AspectSigma < 0 {
+		return fmt.Errorf("Invalid plausibility aspect sigma: %f", c.AspectSigma)
+	}
+
+	if c.AspectSigma == 0 {
+		c.AspectSigma = 3
+	}
+
+	if c.SizeTolerance != 0 && c.SizeTolerance <= 1 {
+		return fmt.Errorf("Invalid plausibility size tolerance: %f", c.SizeTolerance)
+	}
+
+	if c.SizeTolerance == 0 {
+		c.SizeTolerance = 2
+	}
+
+	if c.MinSpeed < 0 {
+		return fmt.Errorf("Invalid plausibility min speed: %f", c.MinSpeed)
+	}
+
+	if c.MinPath < 0 {
+		return fmt.Errorf("Invalid plausibility min path: %f", c.MinPath)
+	}
+
+	return nil
+}
+
+// Priors are priors of car detections learned from plausible tracks of a camera
+type Priors struct {
+	// Samples is number of detections the priors were learned from
+	Samples int `json:"samples"`
+	// AspectMean is mean of log aspect ratio of the detections
+	AspectMean float64 `json:"aspect_mean"`
+	// AspectM2 is sum of squared differences of log aspect ratio from its mean
+	AspectM2 float64 `json:"aspect_m2"`
+	// SumY is sum of bottom edge positions of the detections
+	SumY float64 `json:"sum_y"`
+	// SumH is sum of heights of the detections
+	SumH float64 `json:"sum_h"`
+	// SumYY is sum of squared bottom edge positions of the detections
+	SumYY float64 `json:"sum_yy"`
+	// SumYH is sum of products of bottom edge positions and heights of the detections
+	SumYH float64 `json:"sum_yh"`
+}
+
+// learn updates the priors with detection rectangle r
+func (p *Priors) learn(r image.Rectangle) {
+	a := math.Log(float64(r.Dx()) / float64(r.Dy()))
+	y, h := float64(r.Max.Y), float64(r.Dy())
+
+	p.Samples++
+	d := a - p.AspectMean
+	p.AspectMean += d / float64(p.Samples)
+	p.AspectM2 += d * (a - p.AspectMean)
+
+	p.SumY += y
+	p.SumH += h
+	p.SumYY += y * y
+	p.SumYH += y * h
+}
+
+// aspectDev returns number of standard deviations the aspect ratio of r is away from the mean
+func (p *Priors) aspectDev(r image.Rectangle) float64 {
+	sd := math.Sqrt(p.AspectM2 / float64(p.Samples))
+	if sd == 0 {
+		return 0
+	}
+
+	return math.Abs(math.Log(float64(r.Dx())/float64(r.Dy()))-p.AspectMean) / sd
+}
+
+// height returns height of a car detection with bottom edge at y by linear regression of heights on positions
+func (p *Priors) height(y float64) float64 {
+	n := float64(p.Samples)
+	den := n*p.SumYY - p.SumY*p.SumY
+	if den == 0 {
+		return p.SumH / n
+	}
+
+	b := (n*p.SumYH - p.SumY*p.SumH) / den
+
+	return (p.SumH-b*p.SumY)/n + b*y
+}
+
+// Plausibility suppresses detections and tracks of pedestrians and other objects which are not cars.
+// Detections are suppressed by their class labels and by aspect ratio and size at their position
+// learned from plausible tracks. Tracks are plausible when they move far and fast enough.
+type Plausibility struct {
+	// config is plausibility configuration
+	config *PlausibilityConfig
+	// classes are class labels of cars
+	classes map[int]bool
+	// priors are learned priors of car detections
+	priors *Priors
+}
+
+// NewPlausibility creates new plausibility checks configured by pc and returns it.
+// It loads the priors from the priors file if it exists and returns error if it can't be read.
+func NewPlausibility(pc *PlausibilityConfig) (*Plausibility, error) {
+	p := &Plausibility{
+		config:  pc,
+		classes: make(map[int]bool),
+		priors:  new(Priors),
+	}
+
+	for _, c := range pc.Classes {
+		p.classes[c] = true
+	}
+
+	if pc.PriorsFile != "" {
+		data, err := ioutil.ReadFile(pc.PriorsFile)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(data, p.priors); err != nil {
+				return nil, fmt.Errorf("Failed to parse %s: %v", pc.PriorsFile, err)
+			}
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Detections returns the detections which are plausible cars
+func (p *Plausibility) Detections(detections []*Detection) []*Detection {
+	var cars []*Detection
+	for _, d := range detections {
+		if len(p.classes) > 0 && !p.classes[d.Label] {
+			continue
+		}
+		if d.Rect.Dx() <= 0 || d.Rect.Dy() <= 0 {
+			continue
+		}
+		if p.config.MinSamples > 0 && p.priors.Samples >= p.config.MinSamples {
+			if p.priors.aspectDev(d.Rect) > p.config.AspectSigma {
+				continue
+			}
+			r := float64(d.Rect.Dy()) / p.priors.height(float64(d.Rect.Max.Y))
+			if r > p.config.SizeTolerance || r*p.config.SizeTolerance < 1 {
+				continue
+			}
+		}
+		cars = append(cars, d)
+	}
+
+	return cars
+}
+
+// Tracks returns the cars whose tracks are plausible. A car stays plausible once its track moved
+// min path away from its start and reached min speed. A detection of each plausible car is learned once
+// as a prior of car detections, so that parked cars don't outweigh the cars passing by.
+func (p *Plausibility) Tracks(cars CarMap, detections []*Detection) CarMap {
+	tracks := make(CarMap, len(cars))
+	for id, car := range cars {
+		if !car.plausible {
+			car.plausible = p.plausible(car)
+		}
+		if !car.plausible {
+			continue
+		}
+		tracks[id] = car
+		if p.config.MinSamples > 0 && !car.gone && !car.learned {
+			car.learned = p.learn(car, detections)
+		}
+	}
+
+	return tracks
+}
+
+// plausible returns true if track of car moved min path away from its start and reached min speed.
+// It updates the peak speed of the car with the speed over plausible window ending at its last point,
+// so it must be called for every frame the car is tracked in until it's plausible.
+func (p *Plausibility) plausible(car *Car) bool {
+	if len(car.Traject) == 0 {
+		return false
+	}
+
+	if v, ok := windowSpeed(car, plausibleWindow); ok && v > car.peak {
+		car.peak = v
+	}
+
+	if dist(car.Traject[0], car.Traject[len(car.Traject)-1]) < p.config.MinPath {
+		return false
+	}
+
+	return p.config.MinSpeed == 0 || car.peak >= p.config.MinSpeed
+}
+
+// learn learns the detection at the last position of car as a prior.
+// It returns true if the car was detected at its last position and its detection was learned.
+func (p *Plausibility) learn(car *Car, detections []*Detection) bool {
+	last := car.Traject[len(car.Traject)-1]
+	for _, d := range detections {
+		if d.Point != last {
+			continue
+		}
+		p.priors.learn(d.Rect)
+		if p.config.PriorsFile != "" && p.priors.Samples%priorsSaveEvery == 0 {
+			if err := p.save(); err != nil {
+				fmt.Printf("Error saving priors: %v\n", err)
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// save saves the learned priors to the priors file
+func (p *Plausibility) save() error {
+	data, err := json.Marshal(p.priors)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p.config.PriorsFile, data)
+}
+
+// windowSpeed returns speed of car in pixels per second measured over time window ending at the last point
+// it was detected at. It returns false if the car hasn't been tracked for the window yet.
+func windowSpeed(car *Car, window time.Duration) (float64, bool) {
+	i := car.lastDetected()
+	j := i
+	for j > 0 && (car.Times[i].Sub(car.Times[j]) < window || !car.detected[j]) {
+		j--
+	}
+
+	dt := car.Times[i].Sub(car.Times[j])
+	if dt < window || dt <= 0 {
+		return 0, false
+	}
+
+	return dist(car.Traject[j], car.Traject[i]) / dt.Seconds(), true
+}
+
+// dist returns euclidean distance of points p and q
+func dist(p, q image.Point) float64 {
+	dx := float64(p.X - q.X)
+	dy := float64(p.Y - q.Y)
+
+	return math.Sqrt(dx*dx + dy*dy)
+}
@@ -0,0 +1,111 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+)
+
+// Polygon is a polygon in frame pixel coordinates.
+// It is encoded in JSON as an array of [x, y] points.
+type Polygon []image.Point
+
+// UnmarshalJSON implements json.Unmarshaler interface for Polygon
+func (pg *Polygon) UnmarshalJSON(data []byte) error {
+	var points [][2]int
+	if err := json.Unmarshal(data, &points); err != nil {
+		return fmt.Errorf("Invalid polygon: %v", err)
+	}
+
+	*pg = make(Polygon, len(points))
+	for i, p := range points {
+		(*pg)[i] = image.Pt(p[0], p[1])
+	}
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler interface for Polygon
+func (pg Polygon) MarshalJSON() ([]byte, error) {
+	points := make([][2]int, len(pg))
+	for i, p := range pg {
+		points[i] = [2]int{p.X, p.Y}
+	}
+
+	return json.Marshal(points)
+}
+
+// Validate checks the polygon has at least 3 points which don't all lie on a line and returns error if it does not
+func (pg Polygon) Validate() error {
+	if len(pg) < 3 {
+		return fmt.Errorf("Invalid polygon %v: must have at least 3 points", []image.Point(pg))
+	}
+
+	if area(pg) == 0 {
+		return fmt.Errorf("Invalid polygon %v: must have non-zero area", []image.Point(pg))
+	}
+
+	return nil
+}
+
+// Contains returns true if point p lies inside the polygon
+func (pg Polygon) Contains(p image.Point) bool {
+	inside := false
+	for i, j := 0, len(pg)-1; i < len(pg); j, i = i, i+1 {
+		a, b := pg[i], pg[j]
+		if (a.Y > p.Y) != (b.Y > p.Y) &&
+			float64(p.X) < float64(b.X-a.X)*float64(p.Y-a.Y)/float64(b.Y-a.Y)+float64(a.X) {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// Bounds returns the smallest rectangle containing the polygon
+func (pg Polygon) Bounds() image.Rectangle {
+	if len(pg) == 0 {
+		return image.Rectangle{}
+	}
+
+	r := image.Rectangle{Min: pg[0], Max: pg[0]}
+	for _, p := range pg[1:] {
+		if p.X < r.Min.X {
+			r.Min.X = p.X
+		}
+		if p.Y < r.Min.Y {
+			r.Min.Y = p.Y
+		}
+		if p.X > r.Max.X {
+			r.Max.X = p.X
+		}
+		if p.Y > r.Max.Y {
+			r.Max.Y = p.Y
+		}
+	}
+
+	return r
+}
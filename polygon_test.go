@@ -0,0 +1,50 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestPolygonValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		pg    Polygon
+		valid bool
+	}{
+		{"triangle", Polygon{{0, 0}, {10, 0}, {0, 10}}, true},
+		{"rectangle", Polygon{{0, 0}, {10, 0}, {10, 10}, {0, 10}}, true},
+		{"empty", nil, false},
+		{"two points", Polygon{{0, 0}, {10, 10}}, false},
+		{"collinear points", Polygon{{0, 0}, {5, 5}, {10, 10}}, false},
+		{"repeated point", Polygon{{3, 4}, {3, 4}, {3, 4}, {3, 4}}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.pg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: Validate(%v) error = %v, want valid %v", tt.name, []image.Point(tt.pg), err, tt.valid)
+		}
+	}
+}
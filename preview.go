@@ -0,0 +1,251 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// boundary separates JPEG frames in MJPEG stream
+	boundary = "frame"
+	// snapshotWait is max time a client waits for a new frame
+	snapshotWait = 2 * time.Second
+)
+
+// PreviewConfig is configuration of HTTP live preview of the annotated video
+type PreviewConfig struct {
+	// FPS is max number of frames per second encoded for preview; defaults to 5
+	FPS float64 `json:"fps"`
+	// Width is max width of preview frames in pixels; frames are not scaled down if 0
+	Width int `json:"width"`
+	// Height is max height of preview frames in pixels; frames are not scaled down if 0
+	Height int `json:"height"`
+	// Quality is JPEG quality from 1 to 100; defaults to 75
+	Quality int `json:"quality"`
+}
+
+// Validate checks preview configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *PreviewConfig) Validate() error {
+	if c.FPS < 0 {
+		return fmt.Errorf("Invalid preview FPS: %f", c.FPS)
+	}
+	if c.FPS == 0 {
+		c.FPS = 5
+	}
+
+	if c.Width < 0 || c.Height < 0 {
+		return fmt.Errorf("Invalid preview resolution: %dx%d", c.Width, c.Height)
+	}
+
+	if c.Quality < 0 || c.Quality > 100 {
+		return fmt.Errorf("Invalid preview JPEG quality: %d", c.Quality)
+	}
+	if c.Quality == 0 {
+		c.Quality = 75
+	}
+
+	return nil
+}
+
+// Preview serves annotated video frames as MJPEG stream and JPEG snapshots.
+// Frames are only encoded when there are clients waiting for them.
+type Preview struct {
+	// config is preview configuration
+	config *PreviewConfig
+	// interval is min interval between encoded frames
+	interval time.Duration
+	// mu protects the fields below
+	mu sync.Mutex
+	// jpeg is the last encoded frame
+	jpeg []byte
+	// encoded is time the last frame was encoded
+	encoded time.Time
+	// seq is sequence number of the last frame
+	seq uint64
+	// clients is number of clients waiting for frames
+	clients int
+	// next is closed when a new frame has been encoded
+	next chan struct{}
+}
+
+// NewPreview creates new preview configured in pc and returns it
+func NewPreview(pc *PreviewConfig) *Preview {
+	return &Preview{
+		config:   pc,
+		interval: time.Duration(float64(time.Second) / pc.FPS),
+		next:     make(chan struct{}),
+	}
+}
+
+// Update encodes img as the latest preview frame if there are any clients and max FPS allows it
+func (p *Preview) Update(img gocv.Mat) {
+	p.mu.Lock()
+	skip := p.clients == 0 || time.Since(p.encoded) < p.interval
+	p.mu.Unlock()
+
+	if skip {
+		return
+	}
+
+	data, err := p.encode(img)
+	if err != nil {
+		fmt.Printf("Error encoding preview frame: %v\n", err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.jpeg = data
+	p.encoded = time.Now()
+	p.seq++
+	close(p.next)
+	p.next = make(chan struct{})
+}
+
+// encode scales img down to fit configured resolution and returns it encoded as JPEG
+func (p *Preview) encode(img gocv.Mat) ([]byte, error) {
+	if size := p.size(img.Cols(), img.Rows()); size.X != img.Cols() || size.Y != img.Rows() {
+		small := gocv.NewMat()
+		defer small.Close()
+
+		gocv.Resize(img, &small, size, 0, 0, gocv.InterpolationArea)
+		img = small
+	}
+
+	buf, err := gocv.IMEncodeWithParams(gocv.JPEGFileExt, img, []int{gocv.IMWriteJpegQuality, p.config.Quality})
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Close()
+
+	// copy the bytes as the buffer is released when closed
+	data := make([]byte, buf.Len())
+	copy(data, buf.GetBytes())
+
+	return data, nil
+}
+
+// size returns size of preview frame scaled down from w x h to fit configured resolution keeping aspect ratio
+func (p *Preview) size(w, h int) image.Point {
+	scale := 1.0
+	if p.config.Width > 0 && w > p.config.Width {
+		scale = float64(p.config.Width) / float64(w)
+	}
+	if p.config.Height > 0 && h > p.config.Height {
+		if s := float64(p.config.Height) / float64(h); s < scale {
+			scale = s
+		}
+	}
+
+	return image.Pt(int(float64(w)*scale), int(float64(h)*scale))
+}
+
+// wait waits for a new frame until done is closed or timeout expires and returns the latest frame
+// along with its sequence number. It returns nil frame if no frame has been encoded yet.
+func (p *Preview) wait(done <-chan struct{}, timeout time.Duration) ([]byte, uint64) {
+	p.mu.Lock()
+	p.clients++
+	next := p.next
+	p.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-next:
+	case <-done:
+	case <-timer.C:
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clients--
+
+	return p.jpeg, p.seq
+}
+
+// Snapshot serves the latest annotated frame as JPEG image
+func (p *Preview) Snapshot(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	data := p.jpeg
+	fresh := time.Since(p.encoded) < 2*p.interval
+	p.mu.Unlock()
+
+	if !fresh {
+		data, _ = p.wait(r.Context().Done(), snapshotWait)
+	}
+
+	if data == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("No video frame available"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
+
+// Stream serves annotated frames as MJPEG stream until the client disconnects
+func (p *Preview) Stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+	w.Header().Set("Cache-Control", "no-store")
+
+	var last uint64
+	for {
+		data, seq := p.wait(r.Context().Done(), snapshotWait)
+		if r.Context().Err() != nil {
+			return
+		}
+		// don't resend the same frame when no new frame arrived in time
+		if data == nil || seq == last {
+			continue
+		}
+		last = seq
+
+		fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", boundary, len(data))
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+		fmt.Fprint(w, "\r\n")
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,453 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// QUEUE is the number of messages buffered for each sink
+	QUEUE = 100
+	// DRAIN is max time sinks are given to publish queued messages when closing
+	DRAIN = 10 * time.Second
+)
+
+// MessageType is a type of published message
+type MessageType string
+
+const (
+	// TotalsMessage is a message with periodic parking lot totals
+	TotalsMessage MessageType = "totals"
+	// CommandMessage is a command sent to the program
+	CommandMessage MessageType = "command"
+	// CrossingMessage is an event of car crossing the parking lot entrance
+	CrossingMessage MessageType = "crossing"
+	// OccupancyMessage is an event of parking lot occupancy state change
+	OccupancyMessage MessageType = "occupancy"
+	// CorrectionMessage is an event of parking lot counters being reset or corrected
+	CorrectionMessage MessageType = "correction"
+	// AggregateMessage is aggregate statistics of a time bucket
+	AggregateMessage MessageType = "aggregate"
+	// DwellMessage is an event of tracked car leaving the camera view with its dwell time
+	DwellMessage MessageType = "dwell"
+	// AlertMessage is an operating alert being raised or cleared
+	AlertMessage MessageType = "alert"
+	// ManeuverMessage is an event of a car making wrong-way or U-turn maneuver
+	ManeuverMessage MessageType = "maneuver"
+	// SpeedingMessage is an event of a car exceeding the speed limit
+	SpeedingMessage MessageType = "speeding"
+	// SpaceMessage is an event of parking space becoming occupied or free
+	SpaceMessage MessageType = "space"
+	// SpacesMessage is map of free and occupied parking spaces
+	SpacesMessage MessageType = "spaces"
+	// QueueMessage is queue length at the entry barrier with estimated wait
+	QueueMessage MessageType = "queue"
+)
+
+// Valid returns true if mt is a known message type
+func (mt MessageType) Valid() bool {
+	switch mt {
+	case TotalsMessage, CommandMessage, CrossingMessage, OccupancyMessage, CorrectionMessage,
+		AggregateMessage, DwellMessage, AlertMessage, ManeuverMessage, SpeedingMessage, SpaceMessage, SpacesMessage,
+		QueueMessage:
+		return true
+	default:
+		return false
+	}
+}
+
+// Periodic returns true if messages of type mt are periodic state samples which can be rate limited
+func (mt MessageType) Periodic() bool {
+	return mt == TotalsMessage
+}
+
+// Message is a message published to sinks
+type Message struct {
+	// Type is message type
+	Type MessageType
+	// Time is time the message was created
+	Time time.Time
+	// Payload is JSON encoded message payload
+	Payload []byte
+}
+
+// NewMessage creates new message of type mt with JSON encoded payload and returns it
+func NewMessage(mt MessageType, payload []byte) *Message {
+	return &Message{
+		Type:    mt,
+		Time:    time.Now(),
+		Payload: payload,
+	}
+}
+
+// envelope wraps message payload with message metadata for sinks which publish all messages to one place
+type envelope struct {
+	// Time is time the message was created
+	Time time.Time `json:"time"`
+	// Site is the name of the site
+	Site string `json:"site"`
+	// Lot is the name of the parking lot
+	Lot string `json:"lot"`
+	// Camera is the name of the camera
+	Camera string `json:"camera"`
+	// Type is message type
+	Type MessageType `json:"type"`
+	// Payload is message payload
+	Payload json.RawMessage `json:"payload"`
+}
+
+// newEnvelope wraps message m with metadata from cfg and returns it
+func newEnvelope(cfg *Config, m *Message) *envelope {
+	return &envelope{
+		Time:    m.Time,
+		Site:    cfg.Site,
+		Lot:     cfg.Lot,
+		Camera:  cfg.Camera,
+		Type:    m.Type,
+		Payload: json.RawMessage(m.Payload),
+	}
+}
+
+// Publisher publishes messages to a remote server or local storage
+type Publisher interface {
+	// Publish publishes message m
+	Publish(ctx context.Context, m *Message) error
+	// Close releases all the resources used by the publisher
+	Close() error
+}
+
+// DeadLetterer is implemented by publishers which keep messages that couldn't be published
+type DeadLetterer interface {
+	// DeadLetter keeps message m which couldn't be published due to err
+	DeadLetter(m *Message, err error)
+}
+
+// SinkConfig is configuration of a publishing sink
+type SinkConfig struct {
+	// Name is sink name used in logs
+	Name string `json:"name"`
+	// Type is sink type: mqtt, file or webhook
+	Type string `json:"type"`
+	// Rate is min number of seconds between periodic messages of the same type; defaults to -rate
+	Rate *float64 `json:"rate"`
+	// Messages are types of messages published to the sink; all messages are published if empty
+	Messages []MessageType `json:"messages"`
+	// File is file sink configuration
+	File *FileSinkConfig `json:"file"`
+	// Webhook is webhook sink configuration
+	Webhook *WebhookConfig `json:"webhook"`
+}
+
+// Validate checks the sink configuration is valid and returns error if it is not
+func (c *SinkConfig) Validate() error {
+	if c.Rate != nil && *c.Rate < 0 {
+		return fmt.Errorf("Invalid %s sink rate: %f", c.Name, *c.Rate)
+	}
+
+	for _, mt := range c.Messages {
+		if !mt.Valid() {
+			return fmt.Errorf("Unknown message type in %s sink: %s", c.Name, mt)
+		}
+	}
+
+	switch c.Type {
+	case "mqtt":
+		return nil
+	case "file":
+		if c.File == nil || c.File.Path == "" {
+			return fmt.Errorf("Missing file path in %s sink", c.Name)
+		}
+		return nil
+	case "webhook":
+		if c.Webhook == nil {
+			return fmt.Errorf("Missing webhook configuration in %s sink", c.Name)
+		}
+		if err := c.Webhook.Validate(); err != nil {
+			return fmt.Errorf("Invalid %s sink: %v", c.Name, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown type of %s sink: %q", c.Name, c.Type)
+	}
+}
+
+// sink is a publisher with its own message queue, rate and message filter
+type sink struct {
+	// name is sink name
+	name string
+	// kind is sink type
+	kind string
+	// pub publishes messages
+	pub Publisher
+	// rate is min interval between periodic messages of the same type
+	rate time.Duration
+	// filter contains types of messages published to the sink; nil means all
+	filter map[MessageType]bool
+	// last keeps the time the last periodic message of each type was queued
+	last map[MessageType]time.Time
+	// queue buffers messages waiting to be published
+	queue chan *Message
+	// published counts successfully published messages
+	published int64
+	// failed counts messages which failed to be published
+	failed int64
+	// dropped counts messages dropped because the queue was full
+	dropped int64
+}
+
+// accept returns true if message m passes sink filter and rate limit
+func (s *sink) accept(m *Message) bool {
+	if s.filter != nil && !s.filter[m.Type] {
+		return false
+	}
+
+	if m.Type.Periodic() && s.rate > 0 {
+		if m.Time.Sub(s.last[m.Type]) < s.rate {
+			return false
+		}
+		s.last[m.Type] = m.Time
+	}
+
+	return true
+}
+
+// run publishes queued messages until the queue is closed
+func (s *sink) run(ctx context.Context) {
+	for m := range s.queue {
+		if err := s.pub.Publish(ctx, m); err != nil {
+			atomic.AddInt64(&s.failed, 1)
+			fmt.Printf("Error publishing %s message to %s sink: %v\n", m.Type, s.name, err)
+			continue
+		}
+		atomic.AddInt64(&s.published, 1)
+	}
+}
+
+// FanOut publishes the same messages to several sinks at once.
+// Each sink publishes from its own goroutine so that a slow sink does not hold up the others.
+type FanOut struct {
+	// mu protects sinks rate limits and closed flag
+	mu sync.Mutex
+	// closed is set when the fan-out is closed and no more messages are accepted
+	closed bool
+	// sinks are publishing sinks
+	sinks []*sink
+	// cancel cancels context of messages being published
+	cancel context.CancelFunc
+	// wg waits for sinks to finish publishing
+	wg sync.WaitGroup
+}
+
+// NewFanOut creates new fan-out of sinks configured in cfg and returns it.
+// If no sinks are configured, the messages are published to MQTT server.
+// rate is default number of seconds between periodic messages.
+// Connecting to the sinks is abandoned when ctx is cancelled.
+// It returns error if any of the sinks fails to be created.
+func NewFanOut(ctx context.Context, cfg *Config, rate int) (*FanOut, error) {
+	sinks := cfg.Sinks
+	if len(sinks) == 0 {
+		sinks = []*SinkConfig{{Name: "mqtt", Type: "mqtt"}}
+	}
+
+	run, cancel := context.WithCancel(context.Background())
+	f := &FanOut{cancel: cancel}
+
+	for _, sc := range sinks {
+		pub, err := NewSinkPublisher(ctx, cfg, sc)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Failed to create %s sink: %v", sc.Name, err)
+		}
+
+		s := &sink{
+			name:  sc.Name,
+			kind:  sc.Type,
+			pub:   pub,
+			rate:  time.Duration(rate) * time.Second,
+			last:  make(map[MessageType]time.Time),
+			queue: make(chan *Message, QUEUE),
+		}
+
+		if sc.Rate != nil {
+			s.rate = time.Duration(*sc.Rate * float64(time.Second))
+		}
+
+		if len(sc.Messages) > 0 {
+			s.filter = make(map[MessageType]bool)
+			for _, mt := range sc.Messages {
+				s.filter[mt] = true
+			}
+		}
+
+		f.sinks = append(f.sinks, s)
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			s.run(run)
+		}()
+	}
+
+	return f, nil
+}
+
+// NewSinkPublisher creates publisher of sink configured in sc and returns it
+// Connecting to the sink is abandoned when ctx is cancelled.
+// It returns error if the publisher fails to be created.
+func NewSinkPublisher(ctx context.Context, cfg *Config, sc *SinkConfig) (Publisher, error) {
+	switch sc.Type {
+	case "mqtt":
+		return NewMQTTPublisher(ctx, cfg)
+	case "file":
+		return NewFileSink(cfg, sc.File)
+	case "webhook":
+		return NewWebhookSink(cfg, sc.Webhook)
+	default:
+		return nil, fmt.Errorf("Unknown sink type: %s", sc.Type)
+	}
+}
+
+// Publish queues message m for publishing to all the sinks which accept it.
+// If the queue of any of the sinks is full, the message is dropped for that sink
+// and handed over to the sink's dead letters if it keeps them.
+// It returns error if the message was dropped by any sink or if the fan-out is closed.
+func (f *FanOut) Publish(ctx context.Context, m *Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return fmt.Errorf("%s message dropped: publisher is closed", m.Type)
+	}
+
+	var dropped []string
+	for _, s := range f.sinks {
+		if !s.accept(m) {
+			continue
+		}
+
+		select {
+		case s.queue <- m:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+			dropped = append(dropped, s.name)
+			if dl, ok := s.pub.(DeadLetterer); ok {
+				dl.DeadLetter(m, fmt.Errorf("Queue of %s sink is full", s.name))
+			}
+		}
+	}
+
+	if len(dropped) > 0 {
+		return fmt.Errorf("%s message dropped by sinks %v: queue is full", m.Type, dropped)
+	}
+
+	return nil
+}
+
+// SinkStatus is publishing sink status
+type SinkStatus struct {
+	// Type is sink type
+	Type string `json:"type"`
+	// Queued is number of messages waiting to be published
+	Queued int `json:"queued"`
+	// Published is number of successfully published messages
+	Published int64 `json:"published"`
+	// Failed is number of messages which failed to be published
+	Failed int64 `json:"failed"`
+	// Dropped is number of messages dropped because the sink queue was full
+	Dropped int64 `json:"dropped"`
+	// Connection is MQTT connection state; empty for other sinks
+	Connection string `json:"connection,omitempty"`
+	// Reconnects is number of MQTT reconnections
+	Reconnects int `json:"reconnects,omitempty"`
+	// LastError is the last MQTT connection error
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Status returns status of all the sinks keyed by sink name
+func (f *FanOut) Status() map[string]*SinkStatus {
+	status := make(map[string]*SinkStatus)
+	for _, s := range f.sinks {
+		ss := &SinkStatus{
+			Type:      s.kind,
+			Queued:    len(s.queue),
+			Published: atomic.LoadInt64(&s.published),
+			Failed:    atomic.LoadInt64(&s.failed),
+			Dropped:   atomic.LoadInt64(&s.dropped),
+		}
+		if p, ok := s.pub.(*MQTTPublisher); ok {
+			ms := p.client.Status()
+			ss.Connection = ms.State.String()
+			ss.Reconnects = ms.Reconnects
+			if ms.LastError != nil {
+				ss.LastError = ms.LastError.Error()
+			}
+		}
+		status[s.name] = ss
+	}
+
+	return status
+}
+
+// Close waits for queued messages to be published and closes all the sinks.
+// Messages which are not published within DRAIN time are cancelled.
+func (f *FanOut) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	for _, s := range f.sinks {
+		close(s.queue)
+	}
+	f.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(DRAIN):
+		fmt.Printf("Cancelling messages which were not published within %s\n", DRAIN)
+	}
+	f.cancel()
+	<-done
+
+	var err error
+	for _, s := range f.sinks {
+		if e := s.pub.Close(); e != nil {
+			err = fmt.Errorf("Failed to close %s sink: %v", s.name, e)
+		}
+	}
+
+	return err
+}
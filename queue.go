@@ -0,0 +1,253 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// queueWindow is time window the speed of cars in the queue zone is measured over
+	queueWindow = time.Second
+)
+
+// QueueConfig is configuration of queue length measurement at the entry barrier
+type QueueConfig struct {
+	// Zone is polygon of the queue area in front of the barrier; queue measurement is disabled if empty
+	Zone Polygon `json:"zone"`
+	// MaxSpeed is speed in pixels per second below which a car in the zone is queuing; defaults to 30
+	MaxSpeed float64 `json:"max_speed"`
+	// Window is number of seconds of departures from the queue the wait is estimated from; defaults to 300
+	Window float64 `json:"window"`
+	// Threshold is queue length above which an alert is raised; alerts are disabled if 0
+	Threshold int `json:"threshold"`
+	// AlertTime is number of seconds the queue must be longer than threshold to raise an alert; defaults to 60
+	AlertTime float64 `json:"alert_time"`
+	// Interval is number of seconds after which the queue is published again if its length didn't change;
+	// defaults to 10
+	Interval float64 `json:"interval"`
+}
+
+// Validate checks queue configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *QueueConfig) Validate() error {
+	if len(c.Zone) > 0 {
+		if err := c.Zone.Validate(); err != nil {
+			return fmt.Errorf("Invalid queue zone: %v", err)
+		}
+	}
+
+	if c.MaxSpeed < 0 {
+		return fmt.Errorf("Invalid queue max speed: %f", c.MaxSpeed)
+	}
+	if c.MaxSpeed == 0 {
+		c.MaxSpeed = 30
+	}
+
+	if c.Window < 0 {
+		return fmt.Errorf("Invalid queue window: %f", c.Window)
+	}
+	if c.Window == 0 {
+		c.Window = 300
+	}
+
+	if c.Threshold < 0 {
+		return fmt.Errorf("Invalid queue threshold: %d", c.Threshold)
+	}
+
+	if c.AlertTime < 0 {
+		return fmt.Errorf("Invalid queue alert time: %f", c.AlertTime)
+	}
+	if c.AlertTime == 0 {
+		c.AlertTime = 60
+	}
+
+	if c.Interval < 0 {
+		return fmt.Errorf("Invalid queue interval: %f", c.Interval)
+	}
+	if c.Interval == 0 {
+		c.Interval = 10
+	}
+
+	return nil
+}
+
+// Queue is queue length at the entry barrier with estimated wait
+type Queue struct {
+	// Time is time the queue was measured at
+	Time time.Time `json:"time"`
+	// Camera is name of the camera which monitors the queue
+	Camera string `json:"camera"`
+	// Length is number of cars in the queue
+	Length int `json:"length"`
+	// Throughput is number of cars leaving the queue per minute
+	Throughput float64 `json:"throughput"`
+	// Wait is estimated number of seconds a car joining the queue waits; omitted if no car left the queue yet
+	Wait *float64 `json:"wait,omitempty"`
+}
+
+// QueueMonitor measures queue length at the entry barrier and raises alerts when the queue is too long.
+// It is not safe for concurrent use.
+type QueueMonitor struct {
+	// config is queue configuration
+	config *QueueConfig
+	// start is time the monitor was first updated at
+	start time.Time
+	// queued are the cars which joined the queue
+	queued map[uuid.UUID]*Car
+	// departures are times of the cars leaving the queue within window
+	departures []time.Time
+	// length is the last queue length
+	length int
+	// published is time the queue was last published at
+	published time.Time
+	// over is time since which the queue has been longer than threshold; zero if it hasn't
+	over time.Time
+	// alert is true if the long queue alert is raised
+	alert bool
+}
+
+// NewQueueMonitor creates new queue monitor configured in qc and returns it
+func NewQueueMonitor(qc *QueueConfig) *QueueMonitor {
+	return &QueueMonitor{
+		config: qc,
+		queued: make(map[uuid.UUID]*Car),
+	}
+}
+
+// Update updates the monitor with cars tracked in a frame processed at time t.
+// It returns queue length with estimated wait if the length changed or interval elapsed since it was last
+// returned, nil otherwise, and raised and cleared long queue alerts.
+func (m *QueueMonitor) Update(t time.Time, cars CarMap) (*Queue, []*Alert) {
+	if len(m.config.Zone) == 0 {
+		return nil, nil
+	}
+
+	if m.start.IsZero() {
+		m.start = t
+	}
+
+	length := 0
+	for id, car := range cars {
+		if car.gone || len(car.Traject) == 0 || !m.config.Zone.Contains(car.Traject[len(car.Traject)-1]) {
+			continue
+		}
+		if _, ok := m.queued[id]; ok {
+			length++
+			continue
+		}
+		if v, ok := windowSpeed(car, queueWindow); ok && v < m.config.MaxSpeed {
+			m.queued[id] = car
+			length++
+		}
+	}
+
+	// the cars which joined the queue and left the zone departed; the cars lost by tracking
+	// inside the zone leave the queue without departing
+	for id, car := range m.queued {
+		if c, ok := cars[id]; ok && !c.gone && m.config.Zone.Contains(c.Traject[len(c.Traject)-1]) {
+			continue
+		}
+		delete(m.queued, id)
+		if !m.config.Zone.Contains(car.Traject[car.lastDetected()]) {
+			m.departures = append(m.departures, t)
+		}
+	}
+
+	window := time.Duration(m.config.Window * float64(time.Second))
+	for len(m.departures) > 0 && t.Sub(m.departures[0]) > window {
+		m.departures = m.departures[1:]
+	}
+
+	var alerts []*Alert
+	if m.config.Threshold > 0 {
+		switch {
+		case length > m.config.Threshold && m.over.IsZero():
+			m.over = t
+		case length <= m.config.Threshold && !m.over.IsZero():
+			if m.alert {
+				alerts = append(alerts, m.queueAlert(false, length, t))
+				m.alert = false
+			}
+			m.over = time.Time{}
+		}
+		if !m.alert && !m.over.IsZero() && t.Sub(m.over).Seconds() >= m.config.AlertTime {
+			alerts = append(alerts, m.queueAlert(true, length, t))
+			m.alert = true
+		}
+	}
+
+	interval := time.Duration(m.config.Interval * float64(time.Second))
+	if length == m.length && !m.published.IsZero() && t.Sub(m.published) < interval {
+		return nil, alerts
+	}
+	m.length = length
+	m.published = t
+
+	return m.queue(t), alerts
+}
+
+// queue returns queue length at time t with throughput and wait estimated from departures within window
+func (m *QueueMonitor) queue(t time.Time) *Queue {
+	q := &Queue{
+		Time:   t,
+		Camera: config.Camera,
+		Length: m.length,
+	}
+
+	elapsed := t.Sub(m.start).Seconds()
+	if elapsed > m.config.Window {
+		elapsed = m.config.Window
+	}
+	if elapsed > 0 {
+		q.Throughput = float64(len(m.departures)) / elapsed * 60
+	}
+
+	switch {
+	case m.length == 0:
+		q.Wait = new(float64)
+	case q.Throughput > 0:
+		wait := float64(m.length) / q.Throughput * 60
+		q.Wait = &wait
+	}
+
+	return q
+}
+
+// queueAlert returns long queue alert of queue length at time t.
+// The alert is raised if active is true and cleared otherwise.
+func (m *QueueMonitor) queueAlert(active bool, length int, t time.Time) *Alert {
+	return &Alert{
+		Time:     t,
+		Camera:   config.Camera,
+		Type:     LongQueueAlert,
+		Active:   active,
+		Since:    m.over,
+		Duration: t.Sub(m.over).Seconds(),
+		Length:   length,
+	}
+}
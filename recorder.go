@@ -0,0 +1,407 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// segmentPrefix is file name prefix of rolling video files
+	segmentPrefix = "session-"
+	// clipPrefix is file name prefix of event clips
+	clipPrefix = "event-"
+	// fileTime is time layout used in video file names
+	fileTime = "20060102-150405"
+	// retentionInterval is interval between retention checks
+	retentionInterval = time.Minute
+)
+
+// RecorderConfig is configuration of annotated video recorder
+type RecorderConfig struct {
+	// Dir is directory the video files are written to; recording is disabled if empty
+	Dir string `json:"dir"`
+	// Codec is FourCC code of video codec; defaults to MJPG
+	Codec string `json:"codec"`
+	// Ext is extension of video files matching the codec container; defaults to .avi
+	Ext string `json:"ext"`
+	// FPS is max number of recorded frames per second; defaults to 10
+	FPS float64 `json:"fps"`
+	// Segment is length of rolling video files in seconds; rolling files are not recorded if 0
+	Segment float64 `json:"segment"`
+	// Clips enables recording of event clips around counted crossings
+	Clips bool `json:"clips"`
+	// Pre is number of seconds recorded before the crossing; defaults to 5
+	Pre float64 `json:"pre"`
+	// Post is number of seconds recorded after the crossing; defaults to 5
+	Post float64 `json:"post"`
+	// MaxAge is number of hours recordings are kept for; recordings are kept forever if 0
+	MaxAge float64 `json:"max_age"`
+	// MaxSize is max total size of recordings in MB; unlimited if 0
+	MaxSize int64 `json:"max_size"`
+	// MinFree is min free disk space in MB left by the recordings; unlimited if 0
+	MinFree int64 `json:"min_free"`
+}
+
+// Validate checks recorder configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *RecorderConfig) Validate() error {
+	if c.Dir == "" {
+		return nil
+	}
+
+	if c.Codec == "" {
+		c.Codec = "MJPG"
+	}
+	if len(c.Codec) != 4 {
+		return fmt.Errorf("Invalid recorder codec %q: must be FourCC code", c.Codec)
+	}
+
+	if c.Ext == "" {
+		c.Ext = ".avi"
+	}
+	if !strings.HasPrefix(c.Ext, ".") {
+		c.Ext = "." + c.Ext
+	}
+
+	if c.FPS < 0 {
+		return fmt.Errorf("Invalid recorder FPS: %f", c.FPS)
+	}
+	if c.FPS == 0 {
+		c.FPS = 10
+	}
+
+	if c.Segment < 0 || c.Pre < 0 || c.Post < 0 || c.MaxAge < 0 || c.MaxSize < 0 || c.MinFree < 0 {
+		return fmt.Errorf("Invalid recorder configuration: negative values are not allowed")
+	}
+
+	if c.Segment == 0 && !c.Clips {
+		return fmt.Errorf("Invalid recorder configuration: neither segment nor clips are enabled")
+	}
+
+	if c.Clips && c.Pre == 0 && c.Post == 0 {
+		c.Pre = 5
+		c.Post = 5
+	}
+
+	return nil
+}
+
+// recording is a frame queued for recording
+type recording struct {
+	// img is annotated frame; nil if the frame is not recorded
+	img *gocv.Mat
+	// time is time the frame was displayed
+	time time.Time
+	// crossings are crossings detected in the frame
+	crossings []*Crossing
+}
+
+// video is a video file being recorded
+type video struct {
+	// path is path to the video file
+	path string
+	// w writes the video file; opened with the first frame
+	w *gocv.VideoWriter
+	// start is time the video started
+	start time.Time
+	// end is time the video ends
+	end time.Time
+}
+
+// Recorder records annotated frames to rolling video files and event clips.
+// Frames are written from a separate goroutine so that recording does not hold up the video display.
+type Recorder struct {
+	// config is recorder configuration
+	config *RecorderConfig
+	// interval is min interval between recorded frames
+	interval time.Duration
+	// last is time the last frame was queued for recording
+	last time.Time
+	// queue buffers frames waiting to be recorded
+	queue chan *recording
+	// done is closed when all queued frames are recorded
+	done chan struct{}
+	// ring keeps recent frames written at the beginning of event clips
+	ring []*recording
+	// segment is rolling video file being recorded
+	segment *video
+	// clip is event clip being recorded
+	clip *video
+}
+
+// NewRecorder creates new recorder configured in rc and starts its recording goroutine.
+// It returns error if the video directory can't be created.
+func NewRecorder(rc *RecorderConfig) (*Recorder, error) {
+	if err := os.MkdirAll(rc.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		config:   rc,
+		interval: time.Duration(float64(time.Second) / rc.FPS),
+		queue:    make(chan *recording, QUEUE),
+		done:     make(chan struct{}),
+	}
+
+	go r.run()
+
+	return r, nil
+}
+
+// Write queues annotated frame img and crossings detected in it for recording.
+// The frame is recorded at most at configured FPS; crossings are never dropped.
+func (r *Recorder) Write(img gocv.Mat, crossings []*Crossing) {
+	rec := &recording{time: time.Now(), crossings: crossings}
+	if rec.time.Sub(r.last) >= r.interval {
+		clone := img.Clone()
+		rec.img = &clone
+		r.last = rec.time
+	}
+
+	if rec.img == nil && len(crossings) == 0 {
+		return
+	}
+
+	select {
+	case r.queue <- rec:
+	default:
+		fmt.Printf("Recorder queue is full: dropping frame\n")
+		if rec.img != nil {
+			rec.img.Close()
+		}
+	}
+}
+
+// Close records queued frames and closes all the video files
+func (r *Recorder) Close() error {
+	close(r.queue)
+	<-r.done
+
+	return nil
+}
+
+// run records queued frames until the queue is closed
+func (r *Recorder) run() {
+	defer close(r.done)
+
+	r.retain()
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case rec, ok := <-r.queue:
+			if !ok {
+				r.closeVideo(r.segment)
+				r.closeVideo(r.clip)
+				for _, old := range r.ring {
+					old.img.Close()
+				}
+				return
+			}
+			r.record(rec)
+		case <-ticker.C:
+			r.retain()
+		}
+	}
+}
+
+// record writes frame rec to the rolling video file and event clip and keeps it in the ring buffer
+func (r *Recorder) record(rec *recording) {
+	if r.config.Clips {
+		for _, c := range rec.crossings {
+			r.startClip(c)
+		}
+	}
+
+	if rec.img == nil {
+		return
+	}
+
+	if r.config.Segment > 0 {
+		if r.segment != nil && !rec.time.Before(r.segment.end) {
+			r.closeVideo(r.segment)
+			r.segment = nil
+		}
+		if r.segment == nil {
+			r.segment = r.newVideo(segmentPrefix+rec.time.Format(fileTime), rec.time,
+				time.Duration(r.config.Segment*float64(time.Second)))
+		}
+		r.writeVideo(r.segment, rec.img)
+	}
+
+	if r.clip != nil {
+		r.writeVideo(r.clip, rec.img)
+		if !rec.time.Before(r.clip.end) {
+			r.closeVideo(r.clip)
+			r.clip = nil
+		}
+	}
+
+	if r.config.Pre == 0 {
+		rec.img.Close()
+		return
+	}
+
+	// keep the frame in the ring buffer and drop the frames older than clip pre-event time
+	r.ring = append(r.ring, rec)
+	pre := time.Duration(r.config.Pre * float64(time.Second))
+	for len(r.ring) > 0 && rec.time.Sub(r.ring[0].time) > pre {
+		r.ring[0].img.Close()
+		r.ring = r.ring[1:]
+	}
+}
+
+// startClip starts event clip of crossing c beginning with the frames in the ring buffer.
+// If a clip is already being recorded, it is extended to cover the crossing.
+func (r *Recorder) startClip(c *Crossing) {
+	post := time.Duration(r.config.Post * float64(time.Second))
+
+	if r.clip != nil {
+		r.clip.end = c.Time.Add(post)
+		return
+	}
+
+	id := c.TrackID.String()
+	r.clip = r.newVideo(fmt.Sprintf("%s%s-%s-%s", clipPrefix, c.Time.Format(fileTime), c.Direction, id[:8]), c.Time, post)
+	for _, rec := range r.ring {
+		r.writeVideo(r.clip, rec.img)
+	}
+}
+
+// newVideo returns new video file with name starting at start and lasting for length
+func (r *Recorder) newVideo(name string, start time.Time, length time.Duration) *video {
+	return &video{
+		path:  filepath.Join(r.config.Dir, name+r.config.Ext),
+		start: start,
+		end:   start.Add(length),
+	}
+}
+
+// writeVideo writes img to video file v opening the file with the first frame
+func (r *Recorder) writeVideo(v *video, img *gocv.Mat) {
+	if v.w == nil {
+		w, err := gocv.VideoWriterFile(v.path, r.config.Codec, r.config.FPS, img.Cols(), img.Rows(), true)
+		if err != nil {
+			fmt.Printf("Error creating video file %s: %v\n", v.path, err)
+			return
+		}
+		v.w = w
+	}
+
+	if err := v.w.Write(*img); err != nil {
+		fmt.Printf("Error writing video file %s: %v\n", v.path, err)
+	}
+}
+
+// closeVideo closes video file v and applies retention limits
+func (r *Recorder) closeVideo(v *video) {
+	if v == nil || v.w == nil {
+		return
+	}
+
+	if err := v.w.Close(); err != nil {
+		fmt.Printf("Error closing video file %s: %v\n", v.path, err)
+	}
+	v.w = nil
+
+	r.retain()
+}
+
+// retain removes the oldest recordings exceeding configured age, total size or free disk space limits.
+// Video files which are being recorded are never removed.
+func (r *Recorder) retain() {
+	files, err := ioutil.ReadDir(r.config.Dir)
+	if err != nil {
+		fmt.Printf("Error reading recordings directory %s: %v\n", r.config.Dir, err)
+		return
+	}
+
+	var recordings []os.FileInfo
+	var size int64
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), r.config.Ext) || r.recording(f.Name()) {
+			continue
+		}
+		if !strings.HasPrefix(f.Name(), segmentPrefix) && !strings.HasPrefix(f.Name(), clipPrefix) {
+			continue
+		}
+		recordings = append(recordings, f)
+		size += f.Size()
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].ModTime().Before(recordings[j].ModTime())
+	})
+
+	maxAge := time.Duration(r.config.MaxAge * float64(time.Hour))
+	for _, f := range recordings {
+		expired := maxAge > 0 && time.Since(f.ModTime()) > maxAge
+		tooBig := r.config.MaxSize > 0 && size > r.config.MaxSize<<20
+		if !expired && !tooBig && !r.diskFull() {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(r.config.Dir, f.Name())); err != nil {
+			fmt.Printf("Error removing recording %s: %v\n", f.Name(), err)
+			continue
+		}
+		size -= f.Size()
+	}
+}
+
+// recording returns true if file name is being recorded
+func (r *Recorder) recording(name string) bool {
+	for _, v := range []*video{r.segment, r.clip} {
+		if v != nil && filepath.Base(v.path) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// diskFull returns true if there is less than configured min free space on the recordings disk
+func (r *Recorder) diskFull() bool {
+	if r.config.MinFree == 0 {
+		return false
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(r.config.Dir, &fs); err != nil {
+		fmt.Printf("Error reading free disk space of %s: %v\n", r.config.Dir, err)
+		return false
+	}
+
+	return uint64(fs.Bavail)*uint64(fs.Bsize) < uint64(r.config.MinFree)<<20
+}
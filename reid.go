@@ -0,0 +1,397 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"gocv.io/x/gocv"
+)
+
+const (
+	// reidAlpha is weight of a new descriptor in the running descriptor of a track
+	reidAlpha = 0.2
+)
+
+// ReIDConfig is configuration of re-identification of cars lost by tracking e.g. behind a pillar
+type ReIDConfig struct {
+	// MaxAge is number of seconds lost cars are remembered for; re-identification is disabled if 0
+	MaxAge float64 `json:"max_age"`
+	// MaxDist is max distance in pixels between the last position of a lost car and a new track; defaults to 400
+	MaxDist float64 `json:"max_dist"`
+	// Similarity is min similarity from 0 to 1 of a new track to a lost car to re-identify it;
+	// defaults to 0.8 for color histograms and 0.6 for model embeddings
+	Similarity float64 `json:"similarity"`
+	// Bins are numbers of hue and saturation bins of color histograms; defaults to [16, 8]
+	Bins [2]int `json:"bins"`
+	// Model is path to .bin file of re-identification embedding model; color histograms are used if empty
+	Model string `json:"model"`
+	// ModelConfig is path to .xml file of the re-identification model configuration
+	ModelConfig string `json:"model_config"`
+	// InputSize is width and height of the model input in pixels; defaults to [208, 208]
+	InputSize [2]int `json:"input_size"`
+}
+
+// Validate checks re-identification configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *ReIDConfig) Validate() error {
+	if c.MaxAge < 0 {
+		return fmt.Errorf("Invalid re-identification max age: %f", c.MaxAge)
+	}
+
+	if c.MaxDist < 0 {
+		return fmt.Errorf("Invalid re-identification max distance: %f", c.MaxDist)
+	}
+
+	if c.MaxDist == 0 {
+		c.MaxDist = 400
+	}
+
+	if c.Similarity < 0 || c.Similarity > 1 {
+		return fmt.Errorf("Invalid re-identification similarity: %f", c.Similarity)
+	}
+
+	if c.Similarity == 0 {
+		c.Similarity = 0.8
+		if c.Model != "" {
+			c.Similarity = 0.6
+		}
+	}
+
+	if c.Bins[0] < 0 || c.Bins[1] < 0 {
+		return fmt.Errorf("Invalid re-identification histogram bins: %v", c.Bins)
+	}
+
+	if c.Bins[0] == 0 || c.Bins[1] == 0 {
+		c.Bins = [2]int{16, 8}
+	}
+
+	if c.Model != "" && c.ModelConfig == "" {
+		return fmt.Errorf("Invalid re-identification model configuration: can't be empty")
+	}
+
+	if c.InputSize[0] < 0 || c.InputSize[1] < 0 {
+		return fmt.Errorf("Invalid re-identification model input size: %v", c.InputSize)
+	}
+
+	if c.InputSize[0] == 0 || c.InputSize[1] == 0 {
+		c.InputSize = [2]int{208, 208}
+	}
+
+	return nil
+}
+
+// appearance is appearance of a tracked car
+type appearance struct {
+	// descriptor is running descriptor of the car appearance
+	descriptor []float32
+	// point is the last position of the car
+	point image.Point
+	// car is the lost car; nil while it's tracked
+	car *Car
+	// lost is time the car was lost
+	lost time.Time
+}
+
+// ReID re-identifies cars lost by tracking when they reappear so they keep their track ID and aren't counted twice.
+// Cars are described by color histograms or by embeddings of the re-identification model if it's configured.
+type ReID struct {
+	// config is re-identification configuration
+	config *ReIDConfig
+	// net is re-identification model; nil if color histograms are used
+	net *gocv.Net
+	// tracks are appearances of tracked cars
+	tracks map[uuid.UUID]*appearance
+	// lost are appearances of lost cars
+	lost map[uuid.UUID]*appearance
+}
+
+// NewReID creates new re-identification of cars configured by rc and returns it.
+// The re-identification model runs on CPU so it doesn't compete with car detection for the accelerator.
+// It returns error if the model can't be read.
+func NewReID(rc *ReIDConfig) (*ReID, error) {
+	r := &ReID{
+		config: rc,
+		tracks: make(map[uuid.UUID]*appearance),
+		lost:   make(map[uuid.UUID]*appearance),
+	}
+
+	if rc.MaxAge > 0 && rc.Model != "" {
+		net, err := NewInferModel(rc.Model, rc.ModelConfig, int(gocv.NetBackendDefault), int(gocv.NetTargetCPU))
+		if err != nil {
+			return nil, err
+		}
+		r.net = net
+	}
+
+	return r, nil
+}
+
+// Close closes the re-identification model
+func (r *ReID) Close() error {
+	if r.net == nil {
+		return nil
+	}
+
+	return r.net.Close()
+}
+
+// Update updates appearances of tracked cars with detections in img captured at time t.
+// Cars whose centroids are no longer tracked are remembered as lost. New centroids matching a lost car
+// are given its ID and the car is tracked again in cars with its trajectory and counting state.
+// It must be called after centroids are updated with detections and before cars are updated with centroids.
+func (r *ReID) Update(t time.Time, img *gocv.Mat, detections []*Detection, centroids CentroidMap, cars CarMap) {
+	if r.config.MaxAge == 0 {
+		return
+	}
+
+	for id, a := range r.lost {
+		if t.Sub(a.lost).Seconds() > r.config.MaxAge {
+			delete(r.lost, id)
+		}
+	}
+
+	for id, a := range r.tracks {
+		if _, ok := centroids[id]; ok {
+			continue
+		}
+		delete(r.tracks, id)
+		if car, ok := cars[id]; ok && a.descriptor != nil {
+			a.car, a.lost = car, t
+			r.lost[id] = a
+		}
+	}
+
+	// descriptors of new centroids
+	fresh := make(map[uuid.UUID][]float32)
+	for id, c := range centroids {
+		if c.goneCount > 0 {
+			continue
+		}
+		d := r.describe(img, detections, c.Point)
+		if a, ok := r.tracks[id]; ok {
+			a.point = c.Point
+			a.descriptor = blend(a.descriptor, d, r.net == nil)
+			continue
+		}
+		fresh[id] = d
+	}
+
+	for _, m := range r.match(fresh, centroids) {
+		c, a := centroids[m.id], r.lost[m.lost]
+		recordReidentification(config.Camera)
+		delete(centroids, m.id)
+		delete(fresh, m.id)
+		delete(r.lost, m.lost)
+		c.ID = m.lost
+		centroids[c.ID] = c
+		a.car.gone = false
+		cars[c.ID] = a.car
+		a.car, a.point = nil, c.Point
+		a.descriptor = blend(a.descriptor, m.descriptor, r.net == nil)
+		r.tracks[c.ID] = a
+	}
+
+	for id, d := range fresh {
+		r.tracks[id] = &appearance{descriptor: d, point: centroids[id].Point}
+	}
+}
+
+// reidMatch is a match of a new centroid to a lost car
+type reidMatch struct {
+	// id is ID of the new centroid
+	id uuid.UUID
+	// lost is ID of the lost car
+	lost uuid.UUID
+	// descriptor is descriptor of the new centroid
+	descriptor []float32
+	// similarity is similarity of the new centroid to the lost car
+	similarity float64
+}
+
+// match matches descriptors of new centroids to lost cars and returns the matches.
+// The most similar pairs within max distance and above min similarity are matched first.
+func (r *ReID) match(fresh map[uuid.UUID][]float32, centroids CentroidMap) []*reidMatch {
+	var candidates []*reidMatch
+	for id, d := range fresh {
+		if d == nil {
+			continue
+		}
+		for lost, a := range r.lost {
+			dx := float64(centroids[id].Point.X - a.point.X)
+			dy := float64(centroids[id].Point.Y - a.point.Y)
+			if math.Sqrt(dx*dx+dy*dy) > r.config.MaxDist {
+				continue
+			}
+			if s := similarity(a.descriptor, d, r.net == nil); s >= r.config.Similarity {
+				candidates = append(candidates, &reidMatch{id: id, lost: lost, descriptor: d, similarity: s})
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].similarity > candidates[j].similarity
+	})
+
+	var matches []*reidMatch
+	matched := make(map[uuid.UUID]bool)
+	for _, c := range candidates {
+		if matched[c.id] || matched[c.lost] {
+			continue
+		}
+		matched[c.id], matched[c.lost] = true, true
+		matches = append(matches, c)
+	}
+
+	return matches
+}
+
+// describe returns descriptor of the detection centered at p in img or nil if there is no such detection
+func (r *ReID) describe(img *gocv.Mat, detections []*Detection, p image.Point) []float32 {
+	for _, d := range detections {
+		if d.Point != p {
+			continue
+		}
+		rect := d.Rect.Intersect(image.Rect(0, 0, img.Cols(), img.Rows()))
+		if rect.Empty() {
+			return nil
+		}
+		crop := img.Region(rect)
+		defer crop.Close()
+		if r.net != nil {
+			return r.embedding(crop)
+		}
+		return r.histogram(crop)
+	}
+
+	return nil
+}
+
+// histogram returns hue and saturation histogram of crop normalized to sum of 1
+func (r *ReID) histogram(crop gocv.Mat) []float32 {
+	hsv := gocv.NewMat()
+	defer hsv.Close()
+	gocv.CvtColor(crop, &hsv, gocv.ColorBGRToHSV)
+
+	mask := gocv.NewMat()
+	defer mask.Close()
+	hist := gocv.NewMat()
+	defer hist.Close()
+	gocv.CalcHist([]gocv.Mat{hsv}, []int{0, 1}, mask, &hist, r.config.Bins[:], []float64{0, 180, 0, 256}, false)
+
+	data, err := hist.DataPtrFloat32()
+	if err != nil {
+		return nil
+	}
+
+	return normalize(data, true)
+}
+
+// embedding returns embedding of crop computed by the re-identification model normalized to unit length
+func (r *ReID) embedding(crop gocv.Mat) []float32 {
+	size := image.Pt(r.config.InputSize[0], r.config.InputSize[1])
+	blob := gocv.BlobFromImage(crop, 1.0, size, gocv.NewScalar(0, 0, 0, 0), false, false)
+	defer blob.Close()
+
+	r.net.SetInput(blob, "")
+	out := r.net.Forward("")
+	defer out.Close()
+
+	data, err := out.DataPtrFloat32()
+	if err != nil {
+		return nil
+	}
+
+	return normalize(data, false)
+}
+
+// normalize returns copy of descriptor d normalized to sum of 1 if hist is true or to unit length otherwise.
+// It returns nil if d is all zeros.
+func normalize(d []float32, hist bool) []float32 {
+	var norm float64
+	for _, v := range d {
+		if hist {
+			norm += float64(v)
+		} else {
+			norm += float64(v) * float64(v)
+		}
+	}
+
+	if !hist {
+		norm = math.Sqrt(norm)
+	}
+
+	if norm == 0 {
+		return nil
+	}
+
+	n := make([]float32, len(d))
+	for i, v := range d {
+		n[i] = float32(float64(v) / norm)
+	}
+
+	return n
+}
+
+// blend returns running descriptor d updated with new descriptor n.
+// It returns d if n is nil and n if d is nil.
+func blend(d, n []float32, hist bool) []float32 {
+	if n == nil || len(d) != len(n) {
+		if d == nil {
+			return n
+		}
+		return d
+	}
+
+	b := make([]float32, len(d))
+	for i := range d {
+		b[i] = (1-reidAlpha)*d[i] + reidAlpha*n[i]
+	}
+
+	return normalize(b, hist)
+}
+
+// similarity returns similarity from 0 to 1 of descriptors a and b.
+// It is Bhattacharyya coefficient of histograms if hist is true or cosine similarity of embeddings otherwise.
+func similarity(a, b []float32, hist bool) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var s float64
+	for i := range a {
+		if hist {
+			s += math.Sqrt(float64(a[i]) * float64(b[i]))
+		} else {
+			s += float64(a[i]) * float64(b[i])
+		}
+	}
+
+	return math.Max(0, math.Min(1, s))
+}
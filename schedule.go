@@ -0,0 +1,125 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// ScheduleConfig is configuration of a scheduled counter command
+type ScheduleConfig struct {
+	// Name is schedule name recorded in the audit trail
+	Name string `json:"name"`
+	// Cron is standard 5 field cron expression evaluated in configured time zone
+	Cron string `json:"cron"`
+	// Command is the scheduled command: reset or occupancy
+	Command string `json:"command"`
+	// Occupancy is the occupancy set by the command
+	Occupancy *int `json:"occupancy"`
+	// Reason is reason of the correction recorded in the audit trail
+	Reason string `json:"reason"`
+	// schedule is parsed cron expression
+	schedule cron.Schedule
+}
+
+// Validate checks the schedule configuration is valid and parses its cron expression in time zone tz.
+// It returns error if the configuration is invalid.
+func (c *ScheduleConfig) Validate(tz string) error {
+	if err := c.command().Validate(); err != nil {
+		return fmt.Errorf("Invalid %s schedule: %v", c.Name, err)
+	}
+
+	spec := c.Cron
+	if tz != "" && !strings.HasPrefix(spec, "CRON_TZ=") && !strings.HasPrefix(spec, "TZ=") {
+		spec = "CRON_TZ=" + tz + " " + spec
+	}
+
+	s, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("Invalid cron expression of %s schedule %q: %v", c.Name, c.Cron, err)
+	}
+	c.schedule = s
+
+	return nil
+}
+
+// command returns new command run by the schedule
+func (c *ScheduleConfig) command() *Command {
+	return &Command{
+		Name:      c.Command,
+		Occupancy: c.Occupancy,
+		Reason:    c.Reason,
+		Source:    "schedule:" + c.Name,
+	}
+}
+
+// scheduleRunner sends the commands of schedules to ctrlChan at their scheduled times
+// doneChan is used to receive a signal from the main goroutine to notify the routine to stop and return
+func scheduleRunner(doneChan <-chan struct{}, ctrlChan chan<- *Command, schedules []*ScheduleConfig) error {
+	next := make([]time.Time, len(schedules))
+	now := time.Now()
+	for i, s := range schedules {
+		next[i] = s.schedule.Next(now)
+		fmt.Printf("Schedule %s: next %s at %s\n", s.Name, s.Command, next[i])
+	}
+
+	for {
+		// wait for the earliest scheduled command
+		first := 0
+		for i := range next {
+			if next[i].Before(next[first]) {
+				first = i
+			}
+		}
+
+		timer := time.NewTimer(time.Until(next[first]))
+		select {
+		case <-timer.C:
+		case <-doneChan:
+			timer.Stop()
+			fmt.Printf("Stopping scheduleRunner: received stop signal\n")
+			return nil
+		}
+
+		s := schedules[first]
+		cmd := s.command()
+		cmd.done = make(chan error, 1)
+
+		select {
+		case ctrlChan <- cmd:
+			if err := <-cmd.done; err != nil {
+				fmt.Printf("Error running %s command of %s schedule: %v\n", s.Command, s.Name, err)
+			}
+		case <-doneChan:
+			fmt.Printf("Stopping scheduleRunner: received stop signal\n")
+			return nil
+		}
+
+		next[first] = s.schedule.Next(time.Now())
+	}
+}
@@ -0,0 +1,293 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"time"
+)
+
+// SpaceConfig is configuration of a parking space
+type SpaceConfig struct {
+	// Name is parking space name e.g. A12
+	Name string `json:"name"`
+	// Polygon is parking space polygon in frame pixel coordinates
+	Polygon Polygon `json:"polygon"`
+}
+
+// SpacesConfig is configuration of per-space occupancy detection
+type SpacesConfig struct {
+	// Spaces are monitored parking spaces; per-space occupancy is not detected if empty
+	Spaces []*SpaceConfig `json:"spaces"`
+	// Overlap is fraction of space area a detected car must cover for the space to be occupied; defaults to 0.3
+	Overlap float64 `json:"overlap"`
+	// Frames is number of consecutive frames a space must be seen in a new state before the state changes;
+	// defaults to 10
+	Frames int `json:"frames"`
+}
+
+// Validate checks per-space occupancy configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *SpacesConfig) Validate() error {
+	names := make(map[string]bool)
+	for i, sc := range c.Spaces {
+		if sc == nil || sc.Name == "" {
+			return fmt.Errorf("Invalid parking space %d: name can't be empty", i)
+		}
+		if names[sc.Name] {
+			return fmt.Errorf("Duplicate parking space %s", sc.Name)
+		}
+		names[sc.Name] = true
+		if err := sc.Polygon.Validate(); err != nil {
+			return fmt.Errorf("Invalid parking space %s: %v", sc.Name, err)
+		}
+	}
+
+	if c.Overlap < 0 || c.Overlap > 1 {
+		return fmt.Errorf("Invalid parking space overlap: %f", c.Overlap)
+	}
+	if c.Overlap == 0 {
+		c.Overlap = 0.3
+	}
+
+	if c.Frames < 0 {
+		return fmt.Errorf("Invalid parking space frames: %d", c.Frames)
+	}
+	if c.Frames == 0 {
+		c.Frames = 10
+	}
+
+	return nil
+}
+
+// SpaceState is state of a parking space
+type SpaceState struct {
+	// Name is parking space name
+	Name string `json:"name"`
+	// Occupied is true if a car is parked in the space
+	Occupied bool `json:"occupied"`
+	// Known is false until the space has been seen in the same state for configured number of frames
+	Known bool `json:"known"`
+	// Since is time the space has been in the state since
+	Since time.Time `json:"since"`
+}
+
+// SpaceChange is an event of parking space becoming occupied or free
+type SpaceChange struct {
+	// Time is time of the change
+	Time time.Time `json:"time"`
+	// Camera is name of the camera monitoring the space
+	Camera string `json:"camera"`
+	// Space is parking space name
+	Space string `json:"space"`
+	// Occupied is true if the space became occupied and false if it became free
+	Occupied bool `json:"occupied"`
+	// Duration is number of seconds the space was in the previous state; 0 if the previous state was not known
+	Duration float64 `json:"duration"`
+}
+
+// SpaceMap is map of free and occupied parking spaces
+type SpaceMap struct {
+	// Time is time the map was updated
+	Time time.Time `json:"time"`
+	// Camera is name of the camera monitoring the spaces
+	Camera string `json:"camera"`
+	// Free is number of free parking spaces
+	Free int `json:"free"`
+	// Occupied is number of occupied parking spaces
+	Occupied int `json:"occupied"`
+	// Spaces are states of the parking spaces
+	Spaces []SpaceState `json:"spaces"`
+}
+
+// space is a monitored parking space
+type space struct {
+	// state is the debounced state of the space
+	state SpaceState
+	// polygon is parking space polygon
+	polygon Polygon
+	// area is parking space area in pixels
+	area float64
+	// candidate is the state the space has been seen in other than its current state
+	candidate bool
+	// pending is number of consecutive frames the space has been seen in candidate state
+	pending int
+}
+
+// SpaceMonitor detects occupancy of parking spaces from detected cars.
+// It is not safe for concurrent use.
+type SpaceMonitor struct {
+	// config is per-space occupancy configuration
+	config *SpacesConfig
+	// spaces are monitored parking spaces
+	spaces []*space
+}
+
+// NewSpaceMonitor creates new monitor of parking spaces configured in sc and returns it
+func NewSpaceMonitor(sc *SpacesConfig) *SpaceMonitor {
+	m := &SpaceMonitor{config: sc}
+	for _, c := range sc.Spaces {
+		m.spaces = append(m.spaces, &space{
+			state:   SpaceState{Name: c.Name},
+			polygon: c.Polygon,
+			area:    area(c.Polygon),
+		})
+	}
+
+	return m
+}
+
+// Update updates parking space states with cars detected in a frame at time t.
+// It returns parking space state changes and the updated space map if any state has changed.
+func (m *SpaceMonitor) Update(t time.Time, detections []*Detection) ([]*SpaceChange, *SpaceMap) {
+	if len(m.spaces) == 0 {
+		return nil, nil
+	}
+
+	var changes []*SpaceChange
+	for _, s := range m.spaces {
+		overlap := 0.0
+		for _, d := range detections {
+			overlap = math.Max(overlap, area(clip(s.polygon, d.Rect))/s.area)
+		}
+
+		occupied := overlap >= m.config.Overlap
+		if s.state.Known && occupied == s.state.Occupied {
+			s.pending = 0
+			continue
+		}
+		if s.pending == 0 || occupied != s.candidate {
+			s.candidate = occupied
+			s.pending = 0
+		}
+		if s.pending++; s.pending < m.config.Frames {
+			continue
+		}
+
+		c := &SpaceChange{
+			Time:     t,
+			Camera:   config.Camera,
+			Space:    s.state.Name,
+			Occupied: occupied,
+		}
+		if s.state.Known {
+			c.Duration = t.Sub(s.state.Since).Seconds()
+		}
+		changes = append(changes, c)
+
+		s.state.Occupied = occupied
+		s.state.Known = true
+		s.state.Since = t
+		s.pending = 0
+	}
+
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	return changes, m.Map(t)
+}
+
+// Map returns map of parking spaces at time t
+func (m *SpaceMonitor) Map(t time.Time) *SpaceMap {
+	sm := &SpaceMap{
+		Time:   t,
+		Camera: config.Camera,
+		Spaces: make([]SpaceState, len(m.spaces)),
+	}
+
+	for i, s := range m.spaces {
+		sm.Spaces[i] = s.state
+		switch {
+		case !s.state.Known:
+		case s.state.Occupied:
+			sm.Occupied++
+		default:
+			sm.Free++
+		}
+	}
+
+	return sm
+}
+
+// area returns area of polygon pg in pixels
+func area(pg []image.Point) float64 {
+	a := 0
+	for i, j := 0, len(pg)-1; i < len(pg); j, i = i, i+1 {
+		a += pg[j].X*pg[i].Y - pg[i].X*pg[j].Y
+	}
+
+	return math.Abs(float64(a)) / 2
+}
+
+// clip returns part of polygon pg which lies inside rectangle r
+func clip(pg Polygon, r image.Rectangle) []image.Point {
+	// inside reports whether point p lies inside rectangle edge e
+	edges := []func(p image.Point) bool{
+		func(p image.Point) bool { return p.X >= r.Min.X },
+		func(p image.Point) bool { return p.X <= r.Max.X },
+		func(p image.Point) bool { return p.Y >= r.Min.Y },
+		func(p image.Point) bool { return p.Y <= r.Max.Y },
+	}
+	// intersect returns intersection of line a-b with rectangle edge e
+	intersect := func(a, b image.Point, e int) image.Point {
+		var t float64
+		switch e {
+		case 0:
+			t = float64(r.Min.X-a.X) / float64(b.X-a.X)
+		case 1:
+			t = float64(r.Max.X-a.X) / float64(b.X-a.X)
+		case 2:
+			t = float64(r.Min.Y-a.Y) / float64(b.Y-a.Y)
+		default:
+			t = float64(r.Max.Y-a.Y) / float64(b.Y-a.Y)
+		}
+		return image.Pt(a.X+int(math.Round(t*float64(b.X-a.X))), a.Y+int(math.Round(t*float64(b.Y-a.Y))))
+	}
+
+	// Sutherland-Hodgman clipping of the polygon by each edge of the rectangle
+	out := []image.Point(pg)
+	for e, inside := range edges {
+		in := out
+		out = nil
+		for i := range in {
+			cur, prev := in[i], in[(i+len(in)-1)%len(in)]
+			switch {
+			case inside(cur) && inside(prev):
+				out = append(out, cur)
+			case inside(cur):
+				out = append(out, intersect(prev, cur, e), cur)
+			case inside(prev):
+				out = append(out, intersect(prev, cur, e))
+			}
+		}
+		if len(out) == 0 {
+			return nil
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,91 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestArea(t *testing.T) {
+	tests := []struct {
+		name string
+		pg   []image.Point
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"square", []image.Point{{0, 0}, {100, 0}, {100, 100}, {0, 100}}, 10000},
+		{"counterclockwise square", []image.Point{{0, 0}, {0, 100}, {100, 100}, {100, 0}}, 10000},
+		{"triangle", []image.Point{{0, 0}, {100, 0}, {0, 100}}, 5000},
+		{"odd triangle", []image.Point{{0, 0}, {3, 0}, {0, 3}}, 4.5},
+		{"concave", []image.Point{{0, 0}, {100, 0}, {100, 50}, {50, 50}, {50, 100}, {0, 100}}, 7500},
+		{"line", []image.Point{{0, 0}, {50, 50}, {100, 100}}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := area(tt.pg); got != tt.want {
+			t.Errorf("%s: area() = %f, want %f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClip(t *testing.T) {
+	square := Polygon{{0, 0}, {100, 0}, {100, 100}, {0, 100}}
+	triangle := Polygon{{0, 0}, {100, 0}, {0, 100}}
+
+	tests := []struct {
+		name     string
+		pg       Polygon
+		r        image.Rectangle
+		area     float64
+		vertices int
+	}{
+		{"polygon inside", square, image.Rect(-10, -10, 200, 200), 10000, 4},
+		{"polygon outside", square, image.Rect(300, 300, 400, 400), 0, 0},
+		{"rectangle inside", Polygon{{0, 0}, {1000, 0}, {1000, 1000}, {0, 1000}}, image.Rect(100, 100, 300, 200), 20000, 4},
+		{"half overlap", square, image.Rect(50, -10, 200, 200), 5000, 4},
+		{"corner overlap", square, image.Rect(75, 75, 200, 200), 625, 4},
+		{"rectangle in triangle", triangle, image.Rect(0, 0, 40, 40), 1600, 4},
+		{"triangle tip", triangle, image.Rect(50, 0, 100, 100), 1250, 3},
+		{"diamond", Polygon{{50, 0}, {100, 50}, {50, 100}, {0, 50}}, image.Rect(0, 25, 100, 75), 3750, 6},
+		{"concave", Polygon{{0, 0}, {100, 0}, {100, 50}, {50, 50}, {50, 100}, {0, 100}}, image.Rect(25, 25, 75, 75),
+			1875, 6},
+		{"touching edge", square, image.Rect(100, 0, 200, 100), 0, 4},
+	}
+
+	for _, tt := range tests {
+		got := clip(tt.pg, tt.r)
+		if a := area(got); a != tt.area {
+			t.Errorf("%s: area of clip() = %f, want %f", tt.name, a, tt.area)
+		}
+		if len(got) != tt.vertices {
+			t.Errorf("%s: clip() = %v, want %d vertices", tt.name, got, tt.vertices)
+		}
+		for _, p := range got {
+			if p.X < tt.r.Min.X || p.X > tt.r.Max.X || p.Y < tt.r.Min.Y || p.Y > tt.r.Max.Y {
+				t.Errorf("%s: clip() vertex %v lies outside %v", tt.name, p, tt.r)
+			}
+		}
+	}
+}
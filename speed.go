@@ -0,0 +1,393 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SpeedConfig is configuration of car speed estimation
+type SpeedConfig struct {
+	// Calibration maps frame pixels to ground plane; speed is not estimated if neither it nor calibration file is set
+	Calibration *Calibration `json:"calibration"`
+	// CalibrationFile is path to the file calibration is saved to and loaded from; it overrides Calibration
+	CalibrationFile string `json:"calibration_file"`
+	// Limit is speed limit in km/h; speeding events are disabled if 0
+	Limit float64 `json:"limit"`
+	// Zone is polygon the speed limit applies in; it applies in the whole frame if empty
+	Zone Polygon `json:"zone"`
+	// Window is number of seconds of trajectory the speed is estimated over; defaults to 1
+	Window float64 `json:"window"`
+}
+
+// Validate checks speed configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *SpeedConfig) Validate() error {
+	if c.Calibration != nil {
+		if _, err := c.Calibration.Homography(); err != nil {
+			return err
+		}
+	}
+
+	if c.Limit < 0 {
+		return fmt.Errorf("Invalid speed limit: %f", c.Limit)
+	}
+
+	if len(c.Zone) > 0 {
+		if err := c.Zone.Validate(); err != nil {
+			return fmt.Errorf("Invalid speed limit zone: %v", err)
+		}
+	}
+
+	if c.Window < 0 {
+		return fmt.Errorf("Invalid speed window: %f", c.Window)
+	}
+	if c.Window == 0 {
+		c.Window = 1
+	}
+
+	return nil
+}
+
+// Calibration are four points on the ground in frame pixel coordinates and their real-world coordinates in meters
+type Calibration struct {
+	// ImagePoints are frame pixel coordinates of the points
+	ImagePoints Polygon `json:"image_points"`
+	// WorldPoints are ground plane coordinates of the points in meters
+	WorldPoints [][2]float64 `json:"world_points"`
+}
+
+// Homography returns homography which maps frame pixel coordinates to ground plane coordinates.
+// It returns error if the calibration points are invalid.
+func (c *Calibration) Homography() (*Homography, error) {
+	if len(c.ImagePoints) != 4 || len(c.WorldPoints) != 4 {
+		return nil, fmt.Errorf("Invalid calibration: 4 image points and 4 world points required")
+	}
+
+	return NewHomography(c.ImagePoints, c.WorldPoints)
+}
+
+// Homography is a perspective transformation of frame pixel coordinates to ground plane coordinates
+type Homography [9]float64
+
+// NewHomography computes homography which maps four points src to points dst and returns it.
+// It returns error if three of the points are collinear.
+func NewHomography(src []image.Point, dst [][2]float64) (*Homography, error) {
+	var pts [4][2]float64
+	for i := range pts {
+		pts[i] = [2]float64{float64(src[i].X), float64(src[i].Y)}
+	}
+	if collinear(pts) {
+		return nil, fmt.Errorf("Invalid calibration: image points must not be collinear")
+	}
+	copy(pts[:], dst)
+	if collinear(pts) {
+		return nil, fmt.Errorf("Invalid calibration: world points must not be collinear")
+	}
+
+	// a is augmented matrix of linear equations of the 8 unknown homography coefficients
+	var a [8][9]float64
+	for i := 0; i < 4; i++ {
+		x, y := float64(src[i].X), float64(src[i].Y)
+		u, v := dst[i][0], dst[i][1]
+		a[2*i] = [9]float64{x, y, 1, 0, 0, 0, -u * x, -u * y, u}
+		a[2*i+1] = [9]float64{0, 0, 0, x, y, 1, -v * x, -v * y, v}
+	}
+
+	// Gaussian elimination with partial pivoting
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for row := col + 1; row < 8; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-9 {
+			return nil, fmt.Errorf("Invalid calibration: points must not be collinear")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+
+		for row := 0; row < 8; row++ {
+			if row == col {
+				continue
+			}
+			f := a[row][col] / a[col][col]
+			for k := col; k < 9; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+		}
+	}
+
+	h := new(Homography)
+	for i := 0; i < 8; i++ {
+		h[i] = a[i][8] / a[i][i]
+	}
+	h[8] = 1
+
+	return h, nil
+}
+
+// collinear returns true if any three of points pts lie on a line
+func collinear(pts [4][2]float64) bool {
+	for i := 0; i < 4; i++ {
+		// a, b and c are the points other than i
+		a, b, c := pts[(i+1)%4], pts[(i+2)%4], pts[(i+3)%4]
+		cross := (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+		if math.Abs(cross) < 1e-9 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply maps frame pixel p to ground plane and returns its coordinates in meters
+func (h *Homography) Apply(p image.Point) (float64, float64) {
+	x, y := float64(p.X), float64(p.Y)
+	w := h[6]*x + h[7]*y + h[8]
+
+	return (h[0]*x + h[1]*y + h[2]) / w, (h[3]*x + h[4]*y + h[5]) / w
+}
+
+// Speeding is an event of a car exceeding the speed limit
+type Speeding struct {
+	// Time is time the car exceeded the speed limit
+	Time time.Time `json:"time"`
+	// Camera is name of the camera which observed the car
+	Camera string `json:"camera"`
+	// TrackID is ID of the tracked car
+	TrackID uuid.UUID `json:"track_id"`
+	// Speed is estimated car speed in km/h
+	Speed float64 `json:"speed"`
+	// Limit is speed limit in km/h
+	Limit float64 `json:"limit"`
+	// Point is car position
+	Point image.Point `json:"point"`
+}
+
+// speedTrack are the ground contact points of a tracked car in the frames it was detected in
+type speedTrack struct {
+	// points are bottom center points of the car bounding boxes in frame pixel coordinates
+	points []image.Point
+	// times are times of the points
+	times []time.Time
+	// detections is number of frames the car was detected in when the last point was added
+	detections int
+}
+
+// SpeedMonitor estimates speed of tracked cars and detects the cars exceeding the speed limit.
+// Calibration can be changed while the monitor is in use.
+type SpeedMonitor struct {
+	// config is speed configuration
+	config *SpeedConfig
+	// mu protects calibration, homography and frame size
+	mu sync.RWMutex
+	// calibration is the current calibration; nil if not calibrated
+	calibration *Calibration
+	// homography maps frame pixels to ground plane; nil if not calibrated
+	homography *Homography
+	// frame is size of the processed frames
+	frame image.Point
+	// tracks are ground contact points of the tracked cars within the speed window
+	tracks map[uuid.UUID]*speedTrack
+	// speeding are the cars which have already exceeded the speed limit
+	speeding map[uuid.UUID]bool
+}
+
+// NewSpeedMonitor creates new speed monitor configured in sc and returns it.
+// Calibration is loaded from calibration file if it exists.
+// It returns error if the calibration file can't be read or contains invalid calibration.
+func NewSpeedMonitor(sc *SpeedConfig) (*SpeedMonitor, error) {
+	m := &SpeedMonitor{
+		config:   sc,
+		tracks:   make(map[uuid.UUID]*speedTrack),
+		speeding: make(map[uuid.UUID]bool),
+	}
+
+	c := sc.Calibration
+	if sc.CalibrationFile != "" {
+		data, err := ioutil.ReadFile(sc.CalibrationFile)
+		switch {
+		case err == nil:
+			c = new(Calibration)
+			if err := json.Unmarshal(data, c); err != nil {
+				return nil, fmt.Errorf("Failed to parse %s: %v", sc.CalibrationFile, err)
+			}
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+
+	if c != nil {
+		h, err := c.Homography()
+		if err != nil {
+			return nil, err
+		}
+		m.calibration, m.homography = c, h
+	}
+
+	return m, nil
+}
+
+// Calibration returns the current calibration and size of the processed frames.
+// Calibration is nil if the monitor is not calibrated.
+func (m *SpeedMonitor) Calibration() (*Calibration, image.Point) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.calibration, m.frame
+}
+
+// Calibrate replaces the current calibration with c and saves it to calibration file if configured.
+// It returns error if the calibration is invalid or can't be saved.
+func (m *SpeedMonitor) Calibrate(c *Calibration) error {
+	h, err := c.Homography()
+	if err != nil {
+		return err
+	}
+
+	if m.config.CalibrationFile != "" {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(m.config.CalibrationFile, append(data, '\n')); err != nil {
+			return fmt.Errorf("Failed to save calibration: %v", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calibration, m.homography = c, h
+
+	return nil
+}
+
+// Update estimates speed of cars tracked in frame of size at time t from the ground contact points
+// of the cars in the frames they were detected in.
+// It returns speeding events of the cars which exceeded the speed limit for the first time.
+func (m *SpeedMonitor) Update(t time.Time, cars CarMap, size image.Point) []*Speeding {
+	m.mu.Lock()
+	m.frame = size
+	h := m.homography
+	m.mu.Unlock()
+
+	for id := range m.tracks {
+		if _, ok := cars[id]; !ok {
+			delete(m.tracks, id)
+		}
+	}
+	for id := range m.speeding {
+		if _, ok := cars[id]; !ok {
+			delete(m.speeding, id)
+		}
+	}
+
+	if h == nil {
+		return nil
+	}
+
+	var events []*Speeding
+	for id, car := range cars {
+		st, ok := m.tracks[id]
+		if !ok {
+			st = new(speedTrack)
+			m.tracks[id] = st
+		}
+		// the points repeated in the frames the car was not detected in would slow it down
+		if car.detections == st.detections || car.Rect.Empty() {
+			continue
+		}
+		st.detections = car.detections
+		m.add(st, image.Pt((car.Rect.Min.X+car.Rect.Max.X)/2, car.Rect.Max.Y), t)
+
+		speed, ok := m.speed(st, h)
+		if !ok {
+			continue
+		}
+		car.Speed = speed
+
+		p := car.Traject[len(car.Traject)-1]
+		if m.config.Limit == 0 || speed <= m.config.Limit || m.speeding[id] {
+			continue
+		}
+		if len(m.config.Zone) > 0 && !m.config.Zone.Contains(p) {
+			continue
+		}
+
+		m.speeding[id] = true
+		events = append(events, &Speeding{
+			Time:    t,
+			Camera:  config.Camera,
+			TrackID: id,
+			Speed:   speed,
+			Limit:   m.config.Limit,
+			Point:   p,
+		})
+	}
+
+	return events
+}
+
+// add adds point p seen at time t to speed track st dropping the points which fell out of the speed window
+func (m *SpeedMonitor) add(st *speedTrack, p image.Point, t time.Time) {
+	window := time.Duration(m.config.Window * float64(time.Second))
+	first := 0
+	for first < len(st.times) && t.Sub(st.times[first]) > window {
+		first++
+	}
+
+	st.points = append(st.points[first:], p)
+	st.times = append(st.times[first:], t)
+}
+
+// speed estimates speed in km/h over the speed window of track st mapped to ground plane by h.
+// It returns false if the track is too short to estimate the speed.
+func (m *SpeedMonitor) speed(st *speedTrack, h *Homography) (float64, bool) {
+	last := len(st.times) - 1
+	if last < 1 {
+		return 0, false
+	}
+
+	window := time.Duration(m.config.Window * float64(time.Second))
+	dt := st.times[last].Sub(st.times[0])
+	if dt < window/2 {
+		return 0, false
+	}
+
+	x0, y0 := h.Apply(st.points[0])
+	x1, y1 := h.Apply(st.points[last])
+
+	return math.Hypot(x1-x0, y1-y0) / dt.Seconds() * 3.6, true
+}
@@ -0,0 +1,124 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestHomography(t *testing.T) {
+	// perspective is a known mapping of frame pixels to ground plane the homography must recover
+	perspective := Homography{0.02, 0.004, -3, 0.001, 0.05, -8, 0.0002, 0.0015, 1}
+
+	tests := []struct {
+		name   string
+		src    []image.Point
+		dst    [][2]float64
+		points []image.Point
+		want   [][2]float64
+	}{
+		{
+			name:   "identity",
+			src:    []image.Point{{0, 0}, {100, 0}, {100, 100}, {0, 100}},
+			dst:    [][2]float64{{0, 0}, {100, 0}, {100, 100}, {0, 100}},
+			points: []image.Point{{50, 50}, {-20, 300}},
+			want:   [][2]float64{{50, 50}, {-20, 300}},
+		},
+		{
+			name:   "scale and offset",
+			src:    []image.Point{{100, 100}, {300, 100}, {300, 500}, {100, 500}},
+			dst:    [][2]float64{{0, 0}, {2.5, 0}, {2.5, 5}, {0, 5}},
+			points: []image.Point{{200, 300}, {500, 700}},
+			want:   [][2]float64{{1.25, 2.5}, {5, 7.5}},
+		},
+		{
+			name:   "parking space in perspective",
+			src:    []image.Point{{212, 410}, {468, 402}, {431, 215}, {251, 219}},
+			dst:    project(perspective, []image.Point{{212, 410}, {468, 402}, {431, 215}, {251, 219}}),
+			points: []image.Point{{320, 300}, {0, 479}, {639, 0}},
+			want:   project(perspective, []image.Point{{320, 300}, {0, 479}, {639, 0}}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHomography(tt.src, tt.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the calibration points map to their world coordinates and other points follow the same mapping
+			points := append(append([]image.Point{}, tt.src...), tt.points...)
+			want := append(append([][2]float64{}, tt.dst...), tt.want...)
+			for i, p := range points {
+				x, y := h.Apply(p)
+				if math.Abs(x-want[i][0]) > 1e-6 || math.Abs(y-want[i][1]) > 1e-6 {
+					t.Errorf("Apply(%v) = (%f, %f), want (%f, %f)", p, x, y, want[i][0], want[i][1])
+				}
+			}
+		})
+	}
+}
+
+func TestHomographyInvalid(t *testing.T) {
+	tests := []struct {
+		name        string
+		calibration Calibration
+	}{
+		{"collinear image points", Calibration{
+			ImagePoints: Polygon{{0, 0}, {50, 50}, {100, 100}, {0, 100}},
+			WorldPoints: [][2]float64{{0, 0}, {1, 0}, {1, 1}, {0, 1}},
+		}},
+		{"collinear world points", Calibration{
+			ImagePoints: Polygon{{0, 0}, {100, 0}, {100, 100}, {0, 100}},
+			WorldPoints: [][2]float64{{0, 0}, {1, 1}, {2, 2}, {0, 1}},
+		}},
+		{"three points", Calibration{
+			ImagePoints: Polygon{{0, 0}, {100, 0}, {100, 100}},
+			WorldPoints: [][2]float64{{0, 0}, {1, 0}, {1, 1}},
+		}},
+		{"missing world point", Calibration{
+			ImagePoints: Polygon{{0, 0}, {100, 0}, {100, 100}, {0, 100}},
+			WorldPoints: [][2]float64{{0, 0}, {1, 0}, {1, 1}},
+		}},
+	}
+
+	for _, tt := range tests {
+		if _, err := tt.calibration.Homography(); err == nil {
+			t.Errorf("%s: Homography() succeeded, want error", tt.name)
+		}
+	}
+}
+
+// project maps points by homography h
+func project(h Homography, points []image.Point) [][2]float64 {
+	projected := make([][2]float64, len(points))
+	for i, p := range points {
+		projected[i][0], projected[i][1] = h.Apply(p)
+	}
+
+	return projected
+}
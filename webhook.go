@@ -0,0 +1,363 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBackoff is max delay between webhook delivery retries
+	maxBackoff = 60 * time.Second
+)
+
+// WebhookURLConfig is configuration of webhook URL
+type WebhookURLConfig struct {
+	// URL is URL the messages are POSTed to
+	URL string `json:"url"`
+	// Timeout is request timeout in seconds; defaults to 5 seconds
+	Timeout float64 `json:"timeout"`
+}
+
+// WebhookConfig is configuration of webhook sink
+type WebhookConfig struct {
+	// URLs are URLs the messages are POSTed to
+	URLs []*WebhookURLConfig `json:"urls"`
+	// Secret is HMAC-SHA256 key used to sign requests; requests are not signed if empty
+	Secret string `json:"secret"`
+	// Retries is number of times failed delivery is retried; defaults to 3
+	Retries *int `json:"retries"`
+	// Backoff is number of seconds before the first retry, doubled on every retry; defaults to 1 second
+	Backoff float64 `json:"backoff"`
+	// DeadLetter is path to the file deliveries which failed for good are appended to
+	DeadLetter string `json:"dead_letter"`
+}
+
+// Validate checks webhook configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *WebhookConfig) Validate() error {
+	if len(c.URLs) == 0 {
+		return fmt.Errorf("No webhook URLs configured")
+	}
+
+	for _, u := range c.URLs {
+		if u == nil {
+			return fmt.Errorf("Invalid webhook URL: can't be empty")
+		}
+		parsed, err := url.Parse(u.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("Invalid webhook URL: %q", u.URL)
+		}
+		if u.Timeout < 0 {
+			return fmt.Errorf("Invalid timeout of webhook %s: %f", u.URL, u.Timeout)
+		}
+		if u.Timeout == 0 {
+			u.Timeout = 5
+		}
+	}
+
+	if c.Retries == nil {
+		retries := 3
+		c.Retries = &retries
+	}
+	if *c.Retries < 0 {
+		return fmt.Errorf("Invalid webhook retries: %d", *c.Retries)
+	}
+
+	if c.Backoff < 0 {
+		return fmt.Errorf("Invalid webhook backoff: %f", c.Backoff)
+	}
+	if c.Backoff == 0 {
+		c.Backoff = 1
+	}
+
+	return nil
+}
+
+// WebhookSink POSTs published messages as JSON to configured URLs.
+// Every URL is delivered to from its own queue so that a slow URL does not hold up the others.
+type WebhookSink struct {
+	// config is program configuration
+	config *Config
+	// webhook is webhook configuration
+	webhook *WebhookConfig
+	// client is HTTP client
+	client *http.Client
+	// queues buffer request bodies waiting to be delivered to each of the URLs
+	queues []chan []byte
+	// cancel cancels context of deliveries in progress
+	cancel context.CancelFunc
+	// wg waits for deliveries to finish
+	wg sync.WaitGroup
+	// mu serializes writes to dead letter file
+	mu sync.Mutex
+	// deadLetter is the file undeliverable messages are written to
+	deadLetter *os.File
+}
+
+// deadLetter is a record of undeliverable message written to dead letter file
+type deadLetter struct {
+	// Time is time the delivery was given up
+	Time time.Time `json:"time"`
+	// URL is webhook URL
+	URL string `json:"url"`
+	// Attempts is number of delivery attempts
+	Attempts int `json:"attempts"`
+	// Error is the last delivery error
+	Error string `json:"error"`
+	// Body is request body
+	Body json.RawMessage `json:"body"`
+}
+
+// NewWebhookSink creates new webhook sink configured in wc and returns it.
+// Messages are sent along with site, lot and camera names from cfg.
+// It returns error if dead letter file can't be opened.
+func NewWebhookSink(cfg *Config, wc *WebhookConfig) (*WebhookSink, error) {
+	w := &WebhookSink{
+		config:  cfg,
+		webhook: wc,
+		client:  &http.Client{},
+	}
+
+	if wc.DeadLetter != "" {
+		f, err := os.OpenFile(wc.DeadLetter, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w.deadLetter = f
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	for _, u := range wc.URLs {
+		q := make(chan []byte, QUEUE)
+		w.queues = append(w.queues, q)
+		w.wg.Add(1)
+		go func(u *WebhookURLConfig) {
+			defer w.wg.Done()
+			for body := range q {
+				if err := w.deliver(ctx, u, body); err != nil {
+					fmt.Printf("Error delivering message to webhook %s: %v\n", u.URL, err)
+				}
+			}
+		}(u)
+	}
+
+	return w, nil
+}
+
+// Publish queues message m for delivery to all webhook URLs.
+// Failed deliveries are retried with backoff and written to dead letter file if they fail for good.
+// If the queue of any of the URLs is full, the message is written to dead letter file for that URL.
+// It returns error if the message was dropped for any of the URLs.
+func (w *WebhookSink) Publish(ctx context.Context, m *Message) error {
+	body, err := json.Marshal(newEnvelope(w.config, m))
+	if err != nil {
+		return err
+	}
+
+	var dropped []string
+	for i, q := range w.queues {
+		select {
+		case q <- body:
+		default:
+			u := w.webhook.URLs[i].URL
+			w.writeDeadLetter(u, 0, fmt.Errorf("Queue of %s is full", u), body)
+			dropped = append(dropped, u)
+		}
+	}
+
+	if len(dropped) > 0 {
+		return fmt.Errorf("%s message dropped by webhooks %v: queue is full", m.Type, dropped)
+	}
+
+	return nil
+}
+
+// DeadLetter writes message m which couldn't be published due to err to dead letter file for all webhook URLs
+func (w *WebhookSink) DeadLetter(m *Message, err error) {
+	body, e := json.Marshal(newEnvelope(w.config, m))
+	if e != nil {
+		fmt.Printf("Error encoding dead letter: %v\n", e)
+		return
+	}
+
+	for _, u := range w.webhook.URLs {
+		w.writeDeadLetter(u.URL, 0, err, body)
+	}
+}
+
+// deliver POSTs body to webhook u retrying failed requests with exponential backoff.
+// If the delivery fails for good, body is written to dead letter file.
+// It returns error if the delivery failed.
+func (w *WebhookSink) deliver(ctx context.Context, u *WebhookURLConfig, body []byte) error {
+	backoff := time.Duration(w.webhook.Backoff * float64(time.Second))
+
+	var err error
+	attempts := 0
+retry:
+	for attempts <= *w.webhook.Retries {
+		if attempts > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				break retry
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		attempts++
+
+		var temporary bool
+		if temporary, err = w.post(ctx, u, body); err == nil || !temporary {
+			break
+		}
+	}
+
+	if err != nil {
+		w.writeDeadLetter(u.URL, attempts, err, body)
+	}
+
+	return err
+}
+
+// post sends single POST request with body to webhook u.
+// It returns error if the request failed and whether the failure is temporary and can be retried.
+func (w *WebhookSink) post(ctx context.Context, u *WebhookURLConfig, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(u.Timeout*float64(time.Second)))
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, u.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Counter-Timestamp", ts)
+	if w.webhook.Secret != "" {
+		req.Header.Set("X-Counter-Signature", "sha256="+sign(w.webhook.Secret, ts, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("%s responded with %s", u.URL, resp.Status)
+	temporary := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout
+
+	return temporary, err
+}
+
+// sign returns hex encoded HMAC-SHA256 signature of timestamp ts and body using secret key.
+// The signed content is the timestamp and the body joined with a dot.
+func sign(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// writeDeadLetter appends body which failed to be delivered to url after a number of attempts to dead letter file
+func (w *WebhookSink) writeDeadLetter(url string, attempts int, err error, body []byte) {
+	if w.deadLetter == nil {
+		return
+	}
+
+	data, e := json.Marshal(&deadLetter{
+		Time:     time.Now(),
+		URL:      url,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Body:     json.RawMessage(body),
+	})
+	if e != nil {
+		fmt.Printf("Error encoding dead letter: %v\n", e)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, e := w.deadLetter.Write(append(data, '\n')); e != nil {
+		fmt.Printf("Error writing dead letter: %v\n", e)
+	}
+}
+
+// Close waits for queued messages to be delivered and closes dead letter file.
+// Deliveries which are not finished within DRAIN time are cancelled and written to dead letter file.
+func (w *WebhookSink) Close() error {
+	for _, q := range w.queues {
+		close(q)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(DRAIN):
+		fmt.Printf("Cancelling webhook deliveries which were not finished within %s\n", DRAIN)
+	}
+	w.cancel()
+	<-done
+
+	if w.deadLetter == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.deadLetter.Close()
+}
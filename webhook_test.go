@@ -0,0 +1,264 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		secret string
+		ts     string
+		body   string
+		want   string
+	}{
+		{"s3cret", "1700000000", `{"type":"totals"}`, "616cac1a9df1a99271ef8ea6b5e2772501149b1cb06a3c0f4f29b5a5b92aef18"},
+		{"s3cret", "1700000000", "", "21948100f1d7a89f3338f6b1106fc4f7a702fbe1493b833a3382f80193bde3fe"},
+		{"key", "0", "{}", "7314351dd949aa7ec06f50fc2c96e618291447672c9b7f10b49d1ce46dad00b3"},
+	}
+
+	for _, tt := range tests {
+		if got := sign(tt.secret, tt.ts, []byte(tt.body)); got != tt.want {
+			t.Errorf("sign(%q, %q, %q) = %s, want %s", tt.secret, tt.ts, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	signature := regexp.MustCompile(`^sha256=[0-9a-f]{64}$`)
+
+	tests := []struct {
+		name     string
+		secret   string
+		retries  int
+		statuses []int
+		attempts int
+		fail     bool
+	}{
+		{"delivered", "s3cret", 3, []int{http.StatusOK}, 1, false},
+		{"unsigned", "", 3, []int{http.StatusNoContent}, 1, false},
+		{"retried server error", "s3cret", 3, []int{http.StatusInternalServerError, http.StatusOK}, 2, false},
+		{"retried rate limit", "s3cret", 3, []int{http.StatusTooManyRequests, http.StatusOK}, 2, false},
+		{"client error not retried", "s3cret", 3, []int{http.StatusBadRequest}, 1, true},
+		{"retries exhausted", "s3cret", 2, []int{http.StatusBadGateway}, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := []byte(`{"type":"totals"}`)
+
+			var mu sync.Mutex
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := ioutil.ReadAll(r.Body)
+				sig := r.Header.Get("X-Counter-Signature")
+				switch {
+				case tt.secret == "" && sig != "":
+					t.Errorf("unexpected signature %q", sig)
+				case tt.secret != "" && !signature.MatchString(sig):
+					t.Errorf("signature %q doesn't match sha256=<hex>", sig)
+				case tt.secret != "" && sig != "sha256="+sign(tt.secret, r.Header.Get("X-Counter-Timestamp"), data):
+					t.Errorf("signature %q doesn't sign timestamp and body", sig)
+				}
+
+				mu.Lock()
+				status := tt.statuses[len(tt.statuses)-1]
+				if attempts < len(tt.statuses) {
+					status = tt.statuses[attempts]
+				}
+				attempts++
+				mu.Unlock()
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			wc := &WebhookConfig{
+				URLs:       []*WebhookURLConfig{{URL: srv.URL}},
+				Secret:     tt.secret,
+				Retries:    &tt.retries,
+				Backoff:    0.001,
+				DeadLetter: filepath.Join(t.TempDir(), "dead.jsonl"),
+			}
+			if err := wc.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			w, err := NewWebhookSink(NewConfig(), wc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = w.deliver(context.Background(), wc.URLs[0], body)
+			if (err != nil) != tt.fail {
+				t.Errorf("deliver() error = %v, want failure %v", err, tt.fail)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("deliver() made %d attempts, want %d", attempts, tt.attempts)
+			}
+
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			letters := readDeadLetters(t, wc.DeadLetter)
+			switch {
+			case !tt.fail && len(letters) != 0:
+				t.Errorf("got %d dead letters, want none", len(letters))
+			case tt.fail && len(letters) != 1:
+				t.Errorf("got %d dead letters, want 1", len(letters))
+			case tt.fail && (letters[0].URL != srv.URL || letters[0].Attempts != tt.attempts ||
+				string(letters[0].Body) != string(body)):
+				t.Errorf("dead letter = %+v, want URL %s, %d attempts and body %s", letters[0], srv.URL,
+					tt.attempts, body)
+			}
+		})
+	}
+}
+
+func TestWebhookPublish(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+
+	delivered := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- struct{}{}
+	}))
+	defer fast.Close()
+
+	retries := 0
+	wc := &WebhookConfig{
+		URLs:    []*WebhookURLConfig{{URL: slow.URL, Timeout: 60}, {URL: fast.URL}},
+		Retries: &retries,
+	}
+	if err := wc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWebhookSink(NewConfig(), wc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Publish(context.Background(), NewMessage(TotalsMessage, []byte(`{}`))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Error("delivery to fast URL held up by slow URL")
+	}
+
+	close(release)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFanOutOverflow(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	wc := &WebhookConfig{
+		URLs:       []*WebhookURLConfig{{URL: srv.URL}},
+		DeadLetter: filepath.Join(t.TempDir(), "dead.jsonl"),
+	}
+	if err := wc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWebhookSink(NewConfig(), wc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sink isn't running so its queue fills up after the first message
+	f := &FanOut{
+		sinks:  []*sink{{name: "webhook", kind: "webhook", pub: w, queue: make(chan *Message, 1)}},
+		cancel: func() {},
+	}
+	if err := f.Publish(context.Background(), NewMessage(CrossingMessage, []byte(`{"id":1}`))); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Publish(context.Background(), NewMessage(CrossingMessage, []byte(`{"id":2}`))); err == nil {
+		t.Error("Publish() to full queue succeeded")
+	}
+	if dropped := f.Status()["webhook"].Dropped; dropped != 1 {
+		t.Errorf("dropped %d messages, want 1", dropped)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	letters := readDeadLetters(t, wc.DeadLetter)
+	if len(letters) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(letters))
+	}
+	var e envelope
+	if err := json.Unmarshal(letters[0].Body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != CrossingMessage || string(e.Payload) != `{"id":2}` {
+		t.Errorf("dead letter carries %s message %s, want crossing message {\"id\":2}", e.Type, e.Payload)
+	}
+	if letters[0].URL != srv.URL || letters[0].Attempts != 0 {
+		t.Errorf("dead letter = %+v, want URL %s and 0 attempts", letters[0], srv.URL)
+	}
+}
+
+// readDeadLetters returns dead letters written to file at path
+func readDeadLetters(t *testing.T, path string) []*deadLetter {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var letters []*deadLetter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l := &deadLetter{}
+		if err := json.Unmarshal(scanner.Bytes(), l); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, l)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return letters
+}
@@ -0,0 +1,205 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// WrongWayManeuver is a car travelling against the lane direction
+	WrongWayManeuver = "wrong_way"
+	// UTurnManeuver is a car reversing its direction across the entrance
+	UTurnManeuver = "u_turn"
+	// CountManeuvers counts cars which made a maneuver as any other car
+	CountManeuvers = "count"
+	// IgnoreManeuvers leaves cars which made a maneuver uncounted
+	IgnoreManeuvers = "ignore"
+	// NetZeroManeuvers counts cars which made a maneuver both in and out
+	NetZeroManeuvers = "net_zero"
+)
+
+// WrongWayConfig is configuration of wrong-way and U-turn detection
+type WrongWayConfig struct {
+	// Lane is the only allowed direction of the lane: in or out; wrong-way detection is disabled if empty
+	Lane string `json:"lane"`
+	// MinTravel is number of pixels a car must travel along the entrance axis for its direction to count;
+	// defaults to 50
+	MinTravel int `json:"min_travel"`
+	// Counting is how cars which made a maneuver are counted: count, ignore or net_zero; defaults to count
+	Counting string `json:"counting"`
+}
+
+// Validate checks wrong-way configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *WrongWayConfig) Validate() error {
+	switch c.Lane {
+	case "", DirIn, DirOut:
+	default:
+		return fmt.Errorf("Invalid lane direction %q: must be %s or %s", c.Lane, DirIn, DirOut)
+	}
+
+	if c.MinTravel < 0 {
+		return fmt.Errorf("Invalid min travel: %d", c.MinTravel)
+	}
+	if c.MinTravel == 0 {
+		c.MinTravel = 50
+	}
+
+	switch c.Counting {
+	case "":
+		c.Counting = CountManeuvers
+	case CountManeuvers, IgnoreManeuvers, NetZeroManeuvers:
+	default:
+		return fmt.Errorf("Invalid maneuver counting %q: must be %s, %s or %s", c.Counting,
+			CountManeuvers, IgnoreManeuvers, NetZeroManeuvers)
+	}
+
+	return nil
+}
+
+// Maneuver is an event of a car making wrong-way or U-turn maneuver
+type Maneuver struct {
+	// Time is time the maneuver was detected
+	Time time.Time `json:"time"`
+	// Camera is name of the camera which observed the maneuver
+	Camera string `json:"camera"`
+	// TrackID is ID of the tracked car
+	TrackID uuid.UUID `json:"track_id"`
+	// Type is maneuver type: wrong_way or u_turn
+	Type string `json:"type"`
+	// Counting is how the car was counted: count, ignore or net_zero
+	Counting string `json:"counting"`
+	// Traject is car trajectory
+	Traject []image.Point `json:"trajectory"`
+}
+
+// inward returns position of point p along the entrance axis increasing in the direction of cars entering
+func inward(p image.Point) int {
+	switch entrance {
+	case "t":
+		return p.Y
+	case "l":
+		return p.X
+	case "r":
+		return -p.X
+	default:
+		return -p.Y
+	}
+}
+
+// Maneuver detects wrong-way or U-turn maneuver of the car configured in wc and returns its type.
+// It returns empty string if the car hasn't made any maneuver.
+func (c *Car) Maneuver(wc *WrongWayConfig) string {
+	if len(c.Traject) == 0 {
+		return ""
+	}
+
+	start := inward(c.Traject[0])
+	lo, hi := start, start
+	for _, p := range c.Traject {
+		pos := inward(p)
+		if pos > hi {
+			hi = pos
+		}
+		if pos < lo {
+			lo = pos
+		}
+		// the car travelled one way and then back
+		if (hi-start >= wc.MinTravel && hi-pos >= wc.MinTravel) ||
+			(start-lo >= wc.MinTravel && pos-lo >= wc.MinTravel) {
+			return UTurnManeuver
+		}
+	}
+
+	travel := inward(c.Traject[len(c.Traject)-1]) - start
+	if (wc.Lane == DirIn && travel <= -wc.MinTravel) || (wc.Lane == DirOut && travel >= wc.MinTravel) {
+		return WrongWayManeuver
+	}
+
+	return ""
+}
+
+// Maneuvers detects wrong-way and U-turn maneuvers of tracked cars configured in wc and returns them.
+// Cars which made a maneuver are counted according to wc and are not counted by Update any more;
+// crossing events of the cars counted or reverted and corrections of the reverted counts are returned as well.
+// Cars counted at gates or zones are counted as any other car since crossing a gate or moving between zones back
+// counts them back.
+func (p *ParkingLot) Maneuvers(cars CarMap, wc *WrongWayConfig) ([]*Maneuver, []*Crossing, []*Correction) {
+	var maneuvers []*Maneuver
+	var crossings []*Crossing
+	var corrections []*Correction
+
+	counting := wc.Counting
+	if !config.EntranceCounting() {
+		counting = CountManeuvers
+	}
+
+	for _, car := range cars {
+		if car.maneuver != "" {
+			continue
+		}
+		if car.maneuver = car.Maneuver(wc); car.maneuver == "" {
+			continue
+		}
+
+		switch counting {
+		case IgnoreManeuvers:
+			// revert the count of the car unless it was counted before the counters were reset
+			if car.countedDir != "" && !car.countedAt.Before(p.ResetAt) {
+				before := p.Counts()
+				crossings = append(crossings, p.revert(car))
+				corrections = append(corrections, NewCorrection(ManeuverCorrection, "auto",
+					fmt.Sprintf("%s of car %s", car.maneuver, car.ID), before, p))
+			}
+			car.counted = true
+		case NetZeroManeuvers:
+			// count the car in the direction it hasn't been counted in yet
+			counted := car.countedDir
+			if counted != DirIn {
+				crossings = append(crossings, p.count(car, DirIn))
+			}
+			if counted != DirOut {
+				crossings = append(crossings, p.count(car, DirOut))
+			}
+		}
+
+		traject := make([]image.Point, len(car.Traject))
+		copy(traject, car.Traject)
+		maneuvers = append(maneuvers, &Maneuver{
+			Time:     time.Now(),
+			Camera:   config.Camera,
+			TrackID:  car.ID,
+			Type:     car.maneuver,
+			Counting: counting,
+			Traject:  traject,
+		})
+	}
+
+	return maneuvers, crossings, corrections
+}
@@ -0,0 +1,104 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestManeuvers(t *testing.T) {
+	config = NewConfig()
+	entrance = "b"
+
+	// the car drives 100 pixels in and back out across the bottom entrance
+	uturn := []image.Point{{100, 400}, {100, 350}, {100, 300}, {100, 350}, {100, 400}}
+
+	tests := []struct {
+		name        string
+		counting    string
+		countedDir  string
+		beforeReset bool
+		in          int
+		out         int
+		crossings   int
+		reverted    bool
+		corrections int
+	}{
+		{"count", CountManeuvers, DirIn, false, 1, 0, 0, false, 0},
+		{"ignore uncounted", IgnoreManeuvers, "", false, 0, 0, 0, false, 0},
+		{"ignore counted in", IgnoreManeuvers, DirIn, false, 0, 0, 1, true, 1},
+		{"ignore counted out", IgnoreManeuvers, DirOut, false, 0, 0, 1, true, 1},
+		{"ignore counted before reset", IgnoreManeuvers, DirIn, true, 1, 0, 0, false, 0},
+		{"net zero uncounted", NetZeroManeuvers, "", false, 1, 1, 2, false, 0},
+		{"net zero counted in", NetZeroManeuvers, DirIn, false, 1, 1, 1, false, 0},
+		{"net zero counted out", NetZeroManeuvers, DirOut, false, 1, 1, 1, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wc := &WrongWayConfig{Counting: tt.counting}
+			if err := wc.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			p := &ParkingLot{}
+			car := &Car{ID: uuid.New(), Traject: uturn}
+			if tt.countedDir != "" {
+				p.count(car, tt.countedDir)
+			}
+			if tt.beforeReset {
+				p.ResetAt = car.countedAt.Add(time.Second)
+			}
+
+			maneuvers, crossings, corrections := p.Maneuvers(CarMap{car.ID: car}, wc)
+			if len(maneuvers) != 1 || maneuvers[0].Type != UTurnManeuver {
+				t.Fatalf("Maneuvers() = %v, want a U-turn", maneuvers)
+			}
+			if p.TotalIn != tt.in || p.TotalOut != tt.out {
+				t.Errorf("counted %d in and %d out, want %d in and %d out", p.TotalIn, p.TotalOut, tt.in, tt.out)
+			}
+			if len(crossings) != tt.crossings {
+				t.Fatalf("Maneuvers() = %d crossings, want %d", len(crossings), tt.crossings)
+			}
+			for _, c := range crossings {
+				if c.Revert != tt.reverted {
+					t.Errorf("crossing %s revert = %v, want %v", c.Direction, c.Revert, tt.reverted)
+				}
+			}
+			if len(corrections) != tt.corrections {
+				t.Errorf("Maneuvers() = %d corrections, want %d", len(corrections), tt.corrections)
+			}
+
+			// the maneuver is detected only once
+			if maneuvers, crossings, _ := p.Maneuvers(CarMap{car.ID: car}, wc); len(maneuvers) != 0 ||
+				len(crossings) != 0 {
+				t.Errorf("Maneuvers() detected the maneuver again")
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+/*
+* Copyright (c) 2018 Intel Corporation.
+*
+* Permission is hereby granted, free of charge, to any person obtaining
+* a copy of this software and associated documentation files (the
+* "Software"), to deal in the Software without restriction, including
+* without limitation the rights to use, copy, modify, merge, publish,
+* distribute, sublicense, and/or sell copies of the Software, and to
+* permit persons to whom the Software is furnished to do so, subject to
+* the following conditions:
+*
+* The above copyright notice and this permission notice shall be
+* included in all copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+* EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+* MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+* NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+* LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+* OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+* WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+)
+
+// ZoneConfig is configuration of a counting zone
+type ZoneConfig struct {
+	// Name is zone name e.g. ramp
+	Name string `json:"name"`
+	// Polygon is zone polygon in frame pixel coordinates
+	Polygon Polygon `json:"polygon"`
+}
+
+// TransitionConfig is configuration of a counted transition between zones
+type TransitionConfig struct {
+	// From is name of the zone the car leaves
+	From string `json:"from"`
+	// To is name of the zone the car enters
+	To string `json:"to"`
+	// Direction is direction the transition is counted in the parking lot: in or out
+	Direction string `json:"direction"`
+}
+
+// ZonesConfig is configuration of zone-based counting
+type ZonesConfig struct {
+	// Zones are counting zones; if a point lies in more zones, the first one applies
+	Zones []*ZoneConfig `json:"zones"`
+	// Transitions are counted transitions between the zones
+	Transitions []*TransitionConfig `json:"transitions"`
+	// Frames is number of consecutive frames a car must be in a zone to enter it; defaults to 5
+	Frames int `json:"frames"`
+}
+
+// Validate checks zones configuration is valid and sets defaults of missing options.
+// It returns error if the configuration is invalid.
+func (c *ZonesConfig) Validate() error {
+	names := make(map[string]bool)
+	for i, z := range c.Zones {
+		if z == nil || z.Name == "" {
+			return fmt.Errorf("Invalid zone %d: name can't be empty", i)
+		}
+		if names[z.Name] {
+			return fmt.Errorf("Duplicate zone %s", z.Name)
+		}
+		names[z.Name] = true
+		if err := z.Polygon.Validate(); err != nil {
+			return fmt.Errorf("Invalid zone %s: %v", z.Name, err)
+		}
+	}
+
+	if len(c.Zones) > 0 && len(c.Transitions) == 0 {
+		return fmt.Errorf("No zone transitions configured")
+	}
+
+	for i, t := range c.Transitions {
+		if t == nil {
+			return fmt.Errorf("Invalid zone transition %d: can't be empty", i)
+		}
+		if !names[t.From] || !names[t.To] || t.From == t.To {
+			return fmt.Errorf("Invalid zone transition from %q to %q: zones must exist and differ", t.From, t.To)
+		}
+		if t.Direction != DirIn && t.Direction != DirOut {
+			return fmt.Errorf("Invalid direction of zone transition from %s to %s: %q", t.From, t.To, t.Direction)
+		}
+	}
+
+	if c.Frames < 0 {
+		return fmt.Errorf("Invalid zone frames: %d", c.Frames)
+	}
+	if c.Frames == 0 {
+		c.Frames = 5
+	}
+
+	return nil
+}
+
+// zone returns name of the first zone which contains the last known position of car.
+// It returns empty string if the car is outside all the zones.
+func (c *ZonesConfig) zone(car *Car) string {
+	p := car.Traject[len(car.Traject)-1]
+	for _, z := range c.Zones {
+		if z.Polygon.Contains(p) {
+			return z.Name
+		}
+	}
+
+	return ""
+}
+
+// UpdateZones updates parking lot counters using the cars moving between zones configured in zc.
+// A car is counted when it enters a zone and the last zone it was in makes a configured transition
+// with it, whatever path it took between the zones. A car enters a zone once it has been in the zone
+// for the configured number of consecutive frames, so that a car jittering on a shared border of zones
+// isn't counted over and over.
+// It returns crossing events of the cars which made any of the transitions.
+func (p *ParkingLot) UpdateZones(cars CarMap, zc *ZonesConfig) []*Crossing {
+	var crossings []*Crossing
+	for _, car := range cars {
+		// the frames the car wasn't detected in don't count towards the frames it stays in a zone
+		if len(car.detected) == 0 || !car.detected[len(car.detected)-1] {
+			continue
+		}
+		zone := zc.zone(car)
+		if zone == "" || zone == car.zone {
+			car.nextZone = ""
+			continue
+		}
+
+		if zone != car.nextZone {
+			car.nextZone = zone
+			car.nextZoneFrames = 0
+		}
+		if car.nextZoneFrames++; car.nextZoneFrames < zc.Frames {
+			continue
+		}
+
+		from := car.zone
+		car.zone = zone
+		car.nextZone = ""
+		for _, t := range zc.Transitions {
+			if t.From == from && t.To == zone {
+				c := p.count(car, t.Direction)
+				c.From, c.To = t.From, t.To
+				crossings = append(crossings, c)
+			}
+		}
+	}
+
+	return crossings
+}